@@ -0,0 +1,389 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fastly/go-fastly/fastly"
+	"gopkg.in/resty.v1"
+)
+
+// Policy holds the assertions a WAF has to meet
+type Policy struct {
+	Owasp struct {
+		Min   map[string]int
+		Max   map[string]int
+		Equal map[string]string
+	}
+	Block        []int64
+	Log          []int64
+	NotDisabled  []int64
+	WAFEnabled   bool
+	WAFLog       bool
+	WebLog       bool
+	WebLogExpiry bool
+}
+
+// checkResult is the outcome of a single policy assertion
+type checkResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// checkReport holds the outcome of every policy assertion for a WAF
+type checkReport struct {
+	ServiceID string        `json:"service_id"`
+	WAFID     string        `json:"waf_id"`
+	Version   int           `json:"version"`
+	Policy    string        `json:"policy"`
+	Time      time.Time     `json:"time"`
+	Failures  int           `json:"failures"`
+	Results   []checkResult `json:"results"`
+}
+
+// WAFStatus is the WAF object as returned by the API including its disabled flag
+type WAFStatus struct {
+	Data struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			Disabled bool `json:"disabled"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// expiryPattern extracts the expiry timestamp from the web log condition
+var expiryPattern = regexp.MustCompile(`std\.atoi\(now\.sec\) < (\d+)`)
+
+// loadPolicy reads a policy file
+func loadPolicy(ppath string) (Policy, bool) {
+	var policy Policy
+	if _, err := toml.DecodeFile(ppath, &policy); err != nil {
+		Error.Printf("Cannot read policy file %s: %v\n", ppath, err)
+		return policy, false
+	}
+	return policy, true
+}
+
+// owaspField looks up an OWASP setting by name, ignoring case
+func owaspField(owasp owaspSettings, name string) (reflect.Value, bool) {
+	v := reflect.ValueOf(owasp)
+	for i := 0; i < v.NumField(); i++ {
+		if strings.EqualFold(v.Type().Field(i).Name, name) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// sortedKeys returns the keys of a policy map in a stable order
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkOWASP evaluates the OWASP assertions of a policy
+func checkOWASP(policy Policy, owasp owaspSettings) []checkResult {
+	var results []checkResult
+
+	for _, name := range sortedKeys(policy.Owasp.Min) {
+		r := checkResult{Name: fmt.Sprintf("OWASP %s at least %d", name, policy.Owasp.Min[name])}
+		f, ok := owaspField(owasp, name)
+		switch {
+		case !ok || f.Kind() != reflect.Int:
+			r.Message = "unknown numeric OWASP setting " + name
+		case int(f.Int()) < policy.Owasp.Min[name]:
+			r.Message = fmt.Sprintf("%s is %d", name, f.Int())
+		default:
+			r.Passed = true
+		}
+		results = append(results, r)
+	}
+
+	for _, name := range sortedKeys(policy.Owasp.Max) {
+		r := checkResult{Name: fmt.Sprintf("OWASP %s at most %d", name, policy.Owasp.Max[name])}
+		f, ok := owaspField(owasp, name)
+		switch {
+		case !ok || f.Kind() != reflect.Int:
+			r.Message = "unknown numeric OWASP setting " + name
+		case int(f.Int()) > policy.Owasp.Max[name]:
+			r.Message = fmt.Sprintf("%s is %d", name, f.Int())
+		default:
+			r.Passed = true
+		}
+		results = append(results, r)
+	}
+
+	for _, name := range sortedKeys(policy.Owasp.Equal) {
+		r := checkResult{Name: fmt.Sprintf("OWASP %s is %q", name, policy.Owasp.Equal[name])}
+		f, ok := owaspField(owasp, name)
+		switch {
+		case !ok:
+			r.Message = "unknown OWASP setting " + name
+		case fmt.Sprint(f.Interface()) != policy.Owasp.Equal[name]:
+			r.Message = fmt.Sprintf("%s is %q", name, fmt.Sprint(f.Interface()))
+		default:
+			r.Passed = true
+		}
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// checkRuleStatuses evaluates the rule assertions of a policy
+func checkRuleStatuses(policy Policy, statuses map[string]string) []checkResult {
+	var results []checkResult
+
+	expect := func(ids []int64, name string, ok func(string) bool) {
+		for _, id := range ids {
+			ruleID := strconv.FormatInt(id, 10)
+			r := checkResult{Name: fmt.Sprintf("Rule %s %s", ruleID, name)}
+			status, found := statuses[ruleID]
+			switch {
+			case !found:
+				r.Message = "rule " + ruleID + " not found on the WAF"
+			case !ok(status):
+				r.Message = "rule " + ruleID + " is in " + status
+			default:
+				r.Passed = true
+			}
+			results = append(results, r)
+		}
+	}
+
+	expect(policy.Block, "in block", func(s string) bool { return s == "block" })
+	expect(policy.Log, "in log", func(s string) bool { return s == "log" })
+	expect(policy.NotDisabled, "not disabled", func(s string) bool { return s != "disabled" })
+	return results
+}
+
+// getWAFDisabled reads whether a WAF is disabled
+func getWAFDisabled(apiEndpoint, apiKey, serviceID, wafID string, version int) (bool, bool) {
+	//set our API call
+	apiCall := fmt.Sprintf("%s/service/%s/version/%d/wafs/%s", apiEndpoint, serviceID, version, wafID)
+
+	resp, err := resty.R().
+		SetHeader("Accept", "application/vnd.api+json").
+		SetHeader("Fastly-Key", apiKey).
+		Get(apiCall)
+
+	//check if we had an issue with our call
+	if err != nil {
+		Error.Println("Error with API call: " + apiCall)
+		return false, false
+	}
+
+	body := WAFStatus{}
+	if err := json.Unmarshal(resp.Body(), &body); err != nil || body.Data.ID == "" {
+		Error.Printf("Cannot read WAF %s: %s\n", wafID, resp.String())
+		return false, false
+	}
+	return body.Data.Attributes.Disabled, true
+}
+
+// checkLogging evaluates the logging assertions of a policy
+func checkLogging(client *fastly.Client, policy Policy, serviceID string, version int) []checkResult {
+	var results []checkResult
+	if !policy.WAFLog && !policy.WebLog && !policy.WebLogExpiry {
+		return results
+	}
+
+	syslogs, err := client.ListSyslogs(&fastly.ListSyslogsInput{
+		Service: serviceID,
+		Version: version,
+	})
+	if err != nil {
+		return append(results, checkResult{Name: "Logging endpoints readable", Message: err.Error()})
+	}
+
+	var waflog, weblog *fastly.Syslog
+	for _, s := range syslogs {
+		switch {
+		case s.Placement == "waf_debug":
+			waflog = s
+		case strings.HasPrefix(s.ResponseCondition, "waf-soc-logging"):
+			weblog = s
+		}
+	}
+
+	if policy.WAFLog {
+		r := checkResult{Name: "WAF log endpoint exists", Passed: waflog != nil}
+		if waflog == nil {
+			r.Message = "no syslog endpoint with waf_debug placement"
+		}
+		results = append(results, r)
+	}
+	if policy.WebLog {
+		r := checkResult{Name: "Web log endpoint exists", Passed: weblog != nil}
+		if weblog == nil {
+			r.Message = "no syslog endpoint with a waf-soc-logging condition"
+		}
+		results = append(results, r)
+	}
+	if policy.WebLogExpiry && weblog != nil && weblog.ResponseCondition == "waf-soc-logging-with-expiry" {
+		r := checkResult{Name: "Web log expiry not lapsed"}
+		cond, err := client.GetCondition(&fastly.GetConditionInput{
+			Service: serviceID,
+			Version: version,
+			Name:    weblog.ResponseCondition,
+		})
+		if err != nil {
+			r.Message = err.Error()
+		} else if m := expiryPattern.FindStringSubmatch(cond.Statement); m == nil {
+			r.Message = "no expiry found in condition " + cond.Name
+		} else {
+			exp, _ := strconv.ParseInt(m[1], 10, 64)
+			expiry := time.Unix(exp, 0)
+			r.Passed = time.Now().Before(expiry)
+			if !r.Passed {
+				r.Message = "web log expired on " + expiry.Format(time.RFC3339)
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// writeCheckReport stores the check results as JUnit XML or JSON
+func writeCheckReport(report checkReport, rpath, format string) bool {
+	var out []byte
+	var err error
+
+	switch format {
+	case "json":
+		out, err = json.MarshalIndent(report, "", "  ")
+	default:
+		type failure struct {
+			Message string `xml:"message,attr"`
+		}
+		type testCase struct {
+			ClassName string   `xml:"classname,attr"`
+			Name      string   `xml:"name,attr"`
+			Failure   *failure `xml:"failure,omitempty"`
+		}
+		type testSuite struct {
+			XMLName   xml.Name   `xml:"testsuite"`
+			Name      string     `xml:"name,attr"`
+			Tests     int        `xml:"tests,attr"`
+			Failures  int        `xml:"failures,attr"`
+			Timestamp string     `xml:"timestamp,attr"`
+			Cases     []testCase `xml:"testcase"`
+		}
+		suite := testSuite{
+			Name:      fmt.Sprintf("waflyctl %s WAF %s", report.ServiceID, report.WAFID),
+			Tests:     len(report.Results),
+			Failures:  report.Failures,
+			Timestamp: report.Time.Format("2006-01-02T15:04:05"),
+		}
+		for _, r := range report.Results {
+			c := testCase{ClassName: "waflyctl." + report.ServiceID, Name: r.Name}
+			if !r.Passed {
+				c.Failure = &failure{Message: r.Message}
+			}
+			suite.Cases = append(suite.Cases, c)
+		}
+		out, err = xml.MarshalIndent(suite, "", "  ")
+		out = append([]byte(xml.Header), out...)
+	}
+	if err != nil {
+		Error.Println(err)
+		return false
+	}
+
+	if err := ioutil.WriteFile(rpath, append(out, '\n'), 0644); err != nil {
+		Error.Println(err)
+		return false
+	}
+	Info.Printf("Bytes written: %d to %s\n", len(out)+1, rpath)
+	return true
+}
+
+// checkPolicy evaluates a policy against the live WAF and reports every assertion. It returns false
+// when an assertion fails or the WAF cannot be read.
+func checkPolicy(client *fastly.Client, apiEndpoint, apiKey, serviceID string, waf *fastly.WAF, version int, ppath, rpath, format string) bool {
+	policy, ok := loadPolicy(ppath)
+	if !ok {
+		return false
+	}
+
+	report := checkReport{
+		ServiceID: serviceID,
+		WAFID:     waf.ID,
+		Version:   version,
+		Policy:    ppath,
+		Time:      time.Now().UTC(),
+	}
+
+	//OWASP settings
+	owasp, err := client.GetOWASP(&fastly.GetOWASPInput{
+		Service: serviceID,
+		ID:      waf.ID,
+	})
+	if err != nil {
+		report.Results = append(report.Results, checkResult{Name: "OWASP object readable", Message: err.Error()})
+	} else {
+		report.Results = append(report.Results, checkOWASP(policy, owaspFromFastly(owasp))...)
+	}
+
+	//rule statuses
+	if len(policy.Block)+len(policy.Log)+len(policy.NotDisabled) > 0 {
+		statuses, ok := getRuleStatuses(apiEndpoint, apiKey, serviceID, waf.ID)
+		if !ok {
+			report.Results = append(report.Results, checkResult{Name: "Rule statuses readable", Message: "cannot read rule statuses"})
+		} else {
+			report.Results = append(report.Results, checkRuleStatuses(policy, statuses)...)
+		}
+	}
+
+	//WAF status
+	if policy.WAFEnabled {
+		r := checkResult{Name: "WAF enabled"}
+		disabled, ok := getWAFDisabled(apiEndpoint, apiKey, serviceID, waf.ID, version)
+		switch {
+		case !ok:
+			r.Message = "cannot read WAF status"
+		case disabled:
+			r.Message = "WAF " + waf.ID + " is disabled"
+		default:
+			r.Passed = true
+		}
+		report.Results = append(report.Results, r)
+	}
+
+	report.Results = append(report.Results, checkLogging(client, policy, serviceID, version)...)
+
+	for _, r := range report.Results {
+		if r.Passed {
+			Info.Printf("PASS %s\n", r.Name)
+		} else {
+			report.Failures++
+			Error.Printf("FAIL %s: %s\n", r.Name, r.Message)
+		}
+	}
+	Info.Printf("%d of %d policy checks passed on WAF %s\n", len(report.Results)-report.Failures, len(report.Results), waf.ID)
+
+	if rpath != "" && !writeCheckReport(report, rpath, format) {
+		return false
+	}
+	return report.Failures == 0
+}
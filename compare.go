@@ -0,0 +1,195 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// comparedSetting is a setting whose value differs between the compared services
+type comparedSetting struct {
+	Category string            `json:"category"`
+	Setting  string            `json:"setting"`
+	Values   map[string]string `json:"values"`
+}
+
+// flattenSettings adds every field of a settings struct to a flat setup
+func flattenSettings(setup map[string]string, prefix string, settings interface{}) {
+	v := reflect.ValueOf(settings)
+	for i := 0; i < v.NumField(); i++ {
+		setup[prefix+" "+v.Type().Field(i).Name] = fmt.Sprint(v.Field(i).Interface())
+	}
+}
+
+// flattenSetup turns the WAF setup of a service into setting names and values
+func flattenSetup(config TOMLConfig, statuses map[string]string, configSet string) map[string]string {
+	setup := make(map[string]string)
+	setup["configuration_set"] = configSet
+	flattenSettings(setup, "owasp", config.Owasp)
+	for id, status := range statuses {
+		setup["rule "+id] = status
+	}
+	if config.Prefetch.Name != "" {
+		flattenSettings(setup, "condition "+config.Prefetch.Name, config.Prefetch)
+	}
+	if config.Response.Name != "" {
+		flattenSettings(setup, "response_object "+config.Response.Name, config.Response)
+	}
+	for name, s := range configSnippets(config) {
+		flattenSettings(setup, "snippet "+name, s)
+	}
+	if config.Weblog.Name != "" {
+		flattenSettings(setup, "syslog "+config.Weblog.Name, config.Weblog)
+	}
+	if config.Waflog.Name != "" {
+		flattenSettings(setup, "syslog "+config.Waflog.Name, config.Waflog)
+	}
+	return setup
+}
+
+// readServiceSetup reads the WAF setup of the active version of a service
+func readServiceSetup(client *fastly.Client, apiEndpoint, apiKey, serviceID string) (map[string]string, bool) {
+	version := getActiveVersion(client, serviceID)
+	wafs, err := client.ListWAFs(&fastly.ListWAFsInput{
+		Service: serviceID,
+		Version: version,
+	})
+	if err != nil {
+		Error.Printf("Cannot list WAFs of service %q: ListWAFs: %v\n", serviceID, err)
+		return nil, false
+	}
+	if len(wafs) == 0 {
+		Warning.Printf("No WAF found on service %s version %d\n", serviceID, version)
+		return map[string]string{}, true
+	}
+	if len(wafs) > 1 {
+		Error.Printf("Service %s has %d WAF objects, compare services with a single WAF\n", serviceID, len(wafs))
+		return nil, false
+	}
+
+	Info.Printf("Reading WAF %s from service %s version %d\n", wafs[0].ID, serviceID, version)
+	config, statuses, ok := collectConfig(client, apiEndpoint, apiKey, serviceID, wafs[0], version)
+	if !ok {
+		return nil, false
+	}
+	configSet := ""
+	if wafs[0].ConfigurationSet != nil {
+		configSet = wafs[0].ConfigurationSet.ID
+	}
+	return flattenSetup(config, statuses, configSet), true
+}
+
+// compareSetups lists the settings whose value is not the same on every service
+func compareSetups(services []string, setups map[string]map[string]string) []comparedSetting {
+	names := make(map[string]bool)
+	for _, setup := range setups {
+		for name := range setup {
+			names[name] = true
+		}
+	}
+
+	var diffs []comparedSetting
+	for name := range names {
+		values := make(map[string]string)
+		same := true
+		for _, s := range services {
+			v, ok := setups[s][name]
+			if !ok {
+				v = "-"
+			}
+			values[s] = v
+			if v != values[services[0]] {
+				same = false
+			}
+		}
+		if !same {
+			diffs = append(diffs, comparedSetting{
+				Category: strings.SplitN(name, " ", 2)[0],
+				Setting:  name,
+				Values:   values,
+			})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Category != diffs[j].Category {
+			return diffs[i].Category < diffs[j].Category
+		}
+		return diffs[i].Setting < diffs[j].Setting
+	})
+	return diffs
+}
+
+// printComparison writes the difference matrix as a table, JSON or Markdown
+func printComparison(services []string, diffs []comparedSetting, format string) bool {
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(struct {
+			Services    []string          `json:"services"`
+			Differences []comparedSetting `json:"differences"`
+		}{services, diffs}, "", "  ")
+		if err != nil {
+			Error.Println(err)
+			return false
+		}
+		fmt.Println(string(out))
+
+	case "markdown":
+		fmt.Printf("| Setting | %s |\n", strings.Join(services, " | "))
+		fmt.Printf("|---|%s\n", strings.Repeat("---|", len(services)))
+		for _, d := range diffs {
+			row := make([]string, len(services))
+			for i, s := range services {
+				row[i] = strings.Replace(cutValue(d.Values[s]), "|", "\\|", -1)
+			}
+			fmt.Printf("| %s | %s |\n", d.Setting, strings.Join(row, " | "))
+		}
+
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "SETTING\t%s\n", strings.Join(services, "\t"))
+		for _, d := range diffs {
+			row := make([]string, len(services))
+			for i, s := range services {
+				row[i] = cutValue(d.Values[s])
+			}
+			fmt.Fprintf(w, "%s\t%s\n", d.Setting, strings.Join(row, "\t"))
+		}
+		w.Flush()
+	}
+	return true
+}
+
+// compareServices shows where the WAF setups of several services differ
+func compareServices(client *fastly.Client, apiEndpoint, apiKey string, services []string, format string) bool {
+	setups := make(map[string]map[string]string)
+	for _, s := range services {
+		setup, ok := readServiceSetup(client, apiEndpoint, apiKey, s)
+		if !ok {
+			return false
+		}
+		setups[s] = setup
+	}
+
+	diffs := compareSetups(services, setups)
+	count := make(map[string]int)
+	for _, d := range diffs {
+		count[d.Category]++
+	}
+	Info.Printf("%d difference(s) between %d services: %d rule, %d owasp, %d configuration_set, %d condition, %d response_object, %d snippet, %d syslog\n",
+		len(diffs), len(services), count["rule"], count["owasp"], count["configuration_set"], count["condition"], count["response_object"], count["snippet"], count["syslog"])
+
+	return printComparison(services, diffs, format)
+}
@@ -0,0 +1,320 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// bareKeyPattern matches the keys that need no quotes in TOML
+var bareKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// interpolationPattern matches ${VAR} and ${VAR:-default}, $${ is a literal ${
+var interpolationPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// layeredConfig is the effective config merged from the config file, its includes, the
+// overlays and the command line, with the source of every value and the deprecation warnings
+// of the files migrated on load
+type layeredConfig struct {
+	Tree     map[string]interface{}
+	Sources  map[string]string
+	Meta     toml.MetaData
+	Warnings []string
+}
+
+// interpolate replaces environment variables in every string of a decoded config
+func interpolate(v interface{}, cpath string) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		var missing []string
+		s := interpolationPattern.ReplaceAllStringFunc(t, func(m string) string {
+			if strings.HasPrefix(m, "$$") {
+				return m[1:]
+			}
+			sub := interpolationPattern.FindStringSubmatch(m)
+			if value, ok := os.LookupEnv(sub[1]); ok {
+				return value
+			}
+			if sub[2] != "" {
+				return sub[3]
+			}
+			missing = append(missing, sub[1])
+			return m
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("%s: environment variable %s is not set", cpath, strings.Join(missing, ", "))
+		}
+		return s, nil
+	case map[string]interface{}:
+		for k, e := range t {
+			i, err := interpolate(e, cpath)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = i
+		}
+	case []interface{}:
+		for k, e := range t {
+			i, err := interpolate(e, cpath)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = i
+		}
+	case []map[string]interface{}:
+		for _, e := range t {
+			if _, err := interpolate(e, cpath); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// escapeInterpolation doubles the $ of every ${ in the strings of a config, so values read from
+// Fastly come back unchanged when the config is loaded
+func escapeInterpolation(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		escapeInterpolation(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			escapeInterpolation(v.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			escapeInterpolation(v.Index(i))
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			escapeInterpolation(e)
+			v.SetMapIndex(k, e)
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(strings.Replace(v.String(), "${", "$${", -1))
+		}
+	}
+}
+
+// configKey finds the key of a table matching a name, config keys are not case sensitive
+func configKey(table map[string]interface{}, name string) string {
+	if _, ok := table[name]; ok {
+		return name
+	}
+	for k := range table {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+// mergeConfig deep-merges a config layer into the tree: tables are merged key by key, any other
+// value replaces the one below it. The source of every value set is recorded by key path.
+func mergeConfig(tree, layer map[string]interface{}, prefix, source string, sources map[string]string) {
+	for name, v := range layer {
+		k := configKey(tree, name)
+		key := prefix + k
+		if table, ok := v.(map[string]interface{}); ok {
+			sub, ok := tree[k].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				tree[k] = sub
+				delete(sources, key)
+			}
+			mergeConfig(sub, table, key+".", source, sources)
+			continue
+		}
+		for s := range sources {
+			if strings.HasPrefix(s, key+".") {
+				delete(sources, s)
+			}
+		}
+		tree[k] = v
+		sources[key] = source
+	}
+}
+
+// loadConfigLayer merges a TOML, YAML or JSON config file into the tree after the files it
+// includes, which are looked up relative to it. Older files are migrated to the current schema.
+func loadConfigLayer(cpath string, layered *layeredConfig, seen map[string]bool) error {
+	abs, err := filepath.Abs(cpath)
+	if err != nil {
+		return err
+	}
+	if seen[abs] {
+		return fmt.Errorf("%s includes itself", cpath)
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+
+	b, err := ioutil.ReadFile(cpath)
+	if err != nil {
+		return err
+	}
+	layer, err := decodeTree(cpath, b)
+	if err != nil {
+		return err
+	}
+	notes, err := migrateTree(layer, cpath)
+	if err != nil {
+		return err
+	}
+	layered.Warnings = append(layered.Warnings, notes...)
+	if _, err := interpolate(layer, cpath); err != nil {
+		return err
+	}
+
+	k := configKey(layer, "include")
+	if includes, ok := layer[k]; ok {
+		delete(layer, k)
+		list, ok := includes.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: include must be a list of files", cpath)
+		}
+		for _, i := range list {
+			ipath, ok := i.(string)
+			if !ok {
+				return fmt.Errorf("%s: include must be a list of files", cpath)
+			}
+			if !filepath.IsAbs(ipath) {
+				ipath = filepath.Join(filepath.Dir(cpath), ipath)
+			}
+			if err := loadConfigLayer(ipath, layered, seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	mergeConfig(layered.Tree, layer, "", cpath, layered.Sources)
+	return nil
+}
+
+// loadConfig builds the effective config from the config file, the overlays in order and the
+// command line, then fills in the OWASP preset. Overlays whose path holds <service-id> are optional.
+func loadConfig(configFile string, overlays []string, serviceID string, cli map[string]interface{}) (TOMLConfig, layeredConfig, error) {
+	var config TOMLConfig
+	layered := layeredConfig{
+		Tree:    make(map[string]interface{}),
+		Sources: make(map[string]string),
+	}
+
+	if err := loadConfigLayer(configFile, &layered, make(map[string]bool)); err != nil {
+		return config, layered, err
+	}
+	for _, o := range overlays {
+		opath := strings.Replace(o, "<service-id>", serviceID, -1)
+		if _, err := os.Stat(opath); os.IsNotExist(err) && opath != o {
+			continue
+		}
+		if err := loadConfigLayer(opath, &layered, make(map[string]bool)); err != nil {
+			return config, layered, err
+		}
+	}
+	mergeConfig(layered.Tree, cli, "", "command line", layered.Sources)
+	if err := applyOWASPPreset(&layered); err != nil {
+		return config, layered, err
+	}
+
+	//decode the merged tree the same way a single file is decoded
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(layered.Tree); err != nil {
+		return config, layered, err
+	}
+	meta, err := toml.Decode(buf.String(), &config)
+	if err != nil {
+		return config, layered, err
+	}
+	layered.Meta = meta
+	return config, layered, nil
+}
+
+// renderValue writes a config value in TOML syntax
+func renderValue(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t", "\r", "\\r")
+		return "\"" + r.Replace(t) + "\""
+	case time.Time:
+		return t.Format(time.RFC3339)
+	case []string:
+		values := make([]string, len(t))
+		for i, e := range t {
+			values[i] = renderValue(e)
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case []interface{}:
+		values := make([]string, len(t))
+		for i, e := range t {
+			values[i] = renderValue(e)
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case []map[string]interface{}:
+		tables := make([]string, len(t))
+		for i, e := range t {
+			var fields []string
+			for _, k := range sortedKeys(e) {
+				fields = append(fields, renderKey(k)+" = "+renderValue(e[k]))
+			}
+			tables[i] = "{" + strings.Join(fields, ", ") + "}"
+		}
+		return "[" + strings.Join(tables, ", ") + "]"
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// renderKey quotes a key when it is not a bare TOML key
+func renderKey(k string) string {
+	if bareKeyPattern.MatchString(k) {
+		return k
+	}
+	return renderValue(k)
+}
+
+// renderTable writes the values of a table, then its sub tables
+func renderTable(buf *bytes.Buffer, table map[string]interface{}, path []string, sources map[string]string) {
+	var tables []string
+	for _, k := range sortedKeys(table) {
+		if _, ok := table[k].(map[string]interface{}); ok {
+			tables = append(tables, k)
+			continue
+		}
+		fmt.Fprintf(buf, "%s = %s  # %s\n", renderKey(k), renderValue(table[k]), sources[strings.Join(append(path, k), ".")])
+	}
+
+	for _, k := range tables {
+		sub := append(append([]string{}, path...), k)
+		keys := make([]string, len(sub))
+		for i, s := range sub {
+			keys[i] = renderKey(s)
+		}
+		fmt.Fprintf(buf, "\n[%s]\n", strings.Join(keys, "."))
+		renderTable(buf, table[k].(map[string]interface{}), sub, sources)
+	}
+}
+
+// renderConfig prints the effective config with the file, or the command line, each value comes from
+func renderConfig(layered layeredConfig) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "# effective waflyctl config, every value is followed by where it was set")
+	renderTable(buf, layered.Tree, nil, layered.Sources)
+	fmt.Print(buf.String())
+}
@@ -0,0 +1,131 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("WAFLYCTL_TEST_HOST", "syslog.example.com")
+	os.Unsetenv("WAFLYCTL_TEST_UNSET")
+	defer os.Unsetenv("WAFLYCTL_TEST_HOST")
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"plain", "waf.executed", "waf.executed", false},
+		{"variable", "${WAFLYCTL_TEST_HOST}:514", "syslog.example.com:514", false},
+		{"default", "${WAFLYCTL_TEST_UNSET:-localhost}", "localhost", false},
+		{"empty default", "${WAFLYCTL_TEST_UNSET:-}", "", false},
+		{"set variable wins over the default", "${WAFLYCTL_TEST_HOST:-localhost}", "syslog.example.com", false},
+		{"escaped", "$${WAFLYCTL_TEST_HOST}", "${WAFLYCTL_TEST_HOST}", false},
+		{"not a string", int64(514), int64(514), false},
+		{
+			"nested",
+			map[string]interface{}{
+				"weblog":  map[string]interface{}{"address": "${WAFLYCTL_TEST_HOST}"},
+				"include": []interface{}{"${WAFLYCTL_TEST_UNSET:-base}.toml"},
+			},
+			map[string]interface{}{
+				"weblog":  map[string]interface{}{"address": "syslog.example.com"},
+				"include": []interface{}{"base.toml"},
+			},
+			false,
+		},
+		{"unset", "${WAFLYCTL_TEST_UNSET}", nil, true},
+		{"unset in a table", map[string]interface{}{"address": "${WAFLYCTL_TEST_UNSET}"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := interpolate(tt.value, "waflyctl.toml")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: interpolate() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: interpolate() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		tree        map[string]interface{}
+		layer       map[string]interface{}
+		want        map[string]interface{}
+		wantSources map[string]string
+	}{
+		{
+			name:  "empty tree",
+			tree:  map[string]interface{}{},
+			layer: map[string]interface{}{"action": "log", "owasp": map[string]interface{}{"ParanoiaLevel": int64(1)}},
+			want:  map[string]interface{}{"action": "log", "owasp": map[string]interface{}{"ParanoiaLevel": int64(1)}},
+			wantSources: map[string]string{
+				"action":              "layer.toml",
+				"owasp.ParanoiaLevel": "layer.toml",
+			},
+		},
+		{
+			name: "tables merge key by key, names are not case sensitive",
+			tree: map[string]interface{}{
+				"action": "log",
+				"owasp":  map[string]interface{}{"ParanoiaLevel": int64(1), "MaxNumArgs": int64(255)},
+			},
+			layer: map[string]interface{}{
+				"Action": "block",
+				"OWASP":  map[string]interface{}{"paranoialevel": int64(2)},
+			},
+			want: map[string]interface{}{
+				"action": "block",
+				"owasp":  map[string]interface{}{"ParanoiaLevel": int64(2), "MaxNumArgs": int64(255)},
+			},
+			wantSources: map[string]string{
+				"action":              "layer.toml",
+				"owasp.ParanoiaLevel": "layer.toml",
+				"owasp.MaxNumArgs":    "base.toml",
+			},
+		},
+		{
+			name:  "lists replace lists",
+			tree:  map[string]interface{}{"tags": []interface{}{"wordpress"}},
+			layer: map[string]interface{}{"tags": []interface{}{"drupal", "language-php"}},
+			want:  map[string]interface{}{"tags": []interface{}{"drupal", "language-php"}},
+			wantSources: map[string]string{
+				"tags": "layer.toml",
+			},
+		},
+		{
+			name:  "a value replaces a table",
+			tree:  map[string]interface{}{"weblog": map[string]interface{}{"name": "weblogs"}},
+			layer: map[string]interface{}{"weblog": "none"},
+			want:  map[string]interface{}{"weblog": "none"},
+			wantSources: map[string]string{
+				"weblog": "layer.toml",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		//every value of the tree comes from base.toml
+		sources := make(map[string]string)
+		mergeConfig(map[string]interface{}{}, tt.tree, "", "base.toml", sources)
+		mergeConfig(tt.tree, tt.layer, "", "layer.toml", sources)
+		if !reflect.DeepEqual(tt.tree, tt.want) {
+			t.Errorf("%s: mergeConfig() tree = %v, want %v", tt.name, tt.tree, tt.want)
+		}
+		if !reflect.DeepEqual(sources, tt.wantSources) {
+			t.Errorf("%s: mergeConfig() sources = %v, want %v", tt.name, sources, tt.wantSources)
+		}
+	}
+}
@@ -0,0 +1,553 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// wafSetupChange is a single difference between the WAF setups of two services
+type wafSetupChange struct {
+	Object string
+	Before string
+	After  string
+}
+
+// cutValue keeps a value on one line, cutting long values such as snippet content
+func cutValue(s string) string {
+	s = strings.Replace(s, "\n", "\\n", -1)
+	if len(s) > 60 {
+		s = s[:57] + "..."
+	}
+	return s
+}
+
+// shortValue renders a setting on one line, quoting strings
+func shortValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return cutValue(strconv.Quote(s))
+	}
+	return cutValue(fmt.Sprint(v))
+}
+
+// fieldChanges compares two settings structs field by field
+func fieldChanges(object string, before, after interface{}) []wafSetupChange {
+	var changes []wafSetupChange
+	b := reflect.ValueOf(before)
+	a := reflect.ValueOf(after)
+	for i := 0; i < a.NumField(); i++ {
+		bv := b.Field(i).Interface()
+		av := a.Field(i).Interface()
+		if !reflect.DeepEqual(bv, av) {
+			changes = append(changes, wafSetupChange{
+				Object: object + " " + a.Type().Field(i).Name,
+				Before: shortValue(bv),
+				After:  shortValue(av),
+			})
+		}
+	}
+	return changes
+}
+
+// objectChanges compares a named versioned object of two setups, a missing object shows as created
+func objectChanges(object, beforeName, afterName string, before, after interface{}) []wafSetupChange {
+	switch {
+	case afterName == "":
+		return nil
+	case beforeName != afterName:
+		return []wafSetupChange{{Object: object + " " + afterName, Before: "-", After: "create"}}
+	default:
+		return fieldChanges(object+" "+afterName, before, after)
+	}
+}
+
+// configSnippets lists every snippet of a config by name
+func configSnippets(config TOMLConfig) map[string]VCLSnippetSettings {
+	snippets := make(map[string]VCLSnippetSettings)
+	if config.Vclsnippet.Name != "" {
+		snippets[config.Vclsnippet.Name] = config.Vclsnippet
+	}
+	for _, s := range config.AdditionalSnippets {
+		snippets[s.Name] = s
+	}
+	return snippets
+}
+
+// versionedChanges compares the objects of two setups that live in a service version
+func versionedChanges(src, dst TOMLConfig) []wafSetupChange {
+	var changes []wafSetupChange
+	changes = append(changes, objectChanges("condition", dst.Prefetch.Name, src.Prefetch.Name, dst.Prefetch, src.Prefetch)...)
+	changes = append(changes, objectChanges("response_object", dst.Response.Name, src.Response.Name, dst.Response, src.Response)...)
+
+	srcSnippets := configSnippets(src)
+	dstSnippets := configSnippets(dst)
+	names := make([]string, 0, len(srcSnippets))
+	for name := range srcSnippets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		changes = append(changes, objectChanges("snippet", dstSnippets[name].Name, name, dstSnippets[name], srcSnippets[name])...)
+	}
+
+	changes = append(changes, objectChanges("syslog", dst.Weblog.Name, src.Weblog.Name, dst.Weblog, src.Weblog)...)
+	changes = append(changes, objectChanges("syslog", dst.Waflog.Name, src.Waflog.Name, dst.Waflog, src.Waflog)...)
+	return changes
+}
+
+// ruleChanges lists the rules whose status differs between two setups, grouped by the status to set.
+// Rules the target has and the source lacks are disabled.
+func ruleChanges(src, dst map[string]string) ([]wafSetupChange, map[string][]int64) {
+	var changes []wafSetupChange
+	grouped := make(map[string][]int64)
+
+	want := make(map[string]string, len(src))
+	for id, status := range src {
+		want[id] = status
+	}
+	for id, status := range dst {
+		if _, ok := src[id]; !ok && status != "disabled" {
+			want[id] = "disabled"
+		}
+	}
+
+	ids := make([]string, 0, len(want))
+	for id := range want {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if dst[id] == want[id] {
+			continue
+		}
+		ruleID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			Error.Printf("Failed to parse rule as int %s\n", id)
+			continue
+		}
+		before := dst[id]
+		if before == "" {
+			before = "-"
+		}
+		changes = append(changes, wafSetupChange{Object: "rule " + id, Before: before, After: want[id]})
+		grouped[want[id]] = append(grouped[want[id]], ruleID)
+	}
+	return changes, grouped
+}
+
+// confirm asks the operator to approve an operation on the terminal
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// updatePrefetchCondition brings an existing prefetch condition in line with the config
+func updatePrefetchCondition(client *fastly.Client, serviceID string, before, after PrefetchSettings, version int) {
+	_, err := client.UpdateCondition(&fastly.UpdateConditionInput{
+		Service:   serviceID,
+		Version:   version,
+		Name:      after.Name,
+		Statement: after.Statement,
+		Type:      after.Type,
+		Priority:  after.Priority,
+	})
+	if err != nil {
+		Error.Fatalf("Cannot update prefetch condition %q: UpdateCondition: %v\n", after.Name, err)
+	}
+	Info.Printf("Prefetch condition %q updated\n", after.Name)
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version,
+		Resource:  "condition",
+		Name:      after.Name,
+		Action:    "update",
+		Before:    before,
+		After:     after,
+	})
+}
+
+// updateResponseObject brings an existing response object in line with the config
+func updateResponseObject(client *fastly.Client, serviceID string, before, after ResponseSettings, version int) {
+	_, err := client.UpdateResponseObject(&fastly.UpdateResponseObjectInput{
+		Service:     serviceID,
+		Version:     version,
+		Name:        after.Name,
+		Status:      after.HTTPStatusCode,
+		Response:    after.HTTPResponse,
+		Content:     after.Content,
+		ContentType: after.ContentType,
+	})
+	if err != nil {
+		Error.Fatalf("Cannot update response object %q: UpdateResponseObject: %v\n", after.Name, err)
+	}
+	Info.Printf("Response object %q updated\n", after.Name)
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version,
+		Resource:  "response_object",
+		Name:      after.Name,
+		Action:    "update",
+		Before:    before,
+		After:     after,
+	})
+}
+
+// updateVCLSnippet brings an existing snippet in line with the config. The content of dynamic
+// snippets is versionless and changes on the service right away.
+func updateVCLSnippet(client *fastly.Client, serviceID string, before, after VCLSnippetSettings, version int) {
+	if after.Dynamic == 1 {
+		snippets, err := client.ListSnippets(&fastly.ListSnippetsInput{
+			Service: serviceID,
+			Version: version,
+		})
+		if err != nil {
+			Error.Fatalf("Cannot update VCL snippet %q: ListSnippets: %v\n", after.Name, err)
+		}
+		for _, s := range snippets {
+			if s.Name != after.Name {
+				continue
+			}
+			_, err = client.UpdateDynamicSnippet(&fastly.UpdateDynamicSnippetInput{
+				Service: serviceID,
+				ID:      s.ID,
+				Content: after.Content,
+			})
+			if err != nil {
+				Error.Fatalf("Cannot update VCL snippet %q: UpdateDynamicSnippet: %v\n", after.Name, err)
+			}
+		}
+	} else {
+		_, err := client.UpdateSnippet(&fastly.UpdateSnippetInput{
+			Service:  serviceID,
+			Version:  version,
+			Name:     after.Name,
+			NewName:  after.Name,
+			Priority: after.Priority,
+			Dynamic:  after.Dynamic,
+			Content:  after.Content,
+			Type:     after.Type,
+		})
+		if err != nil {
+			Error.Fatalf("Cannot update VCL snippet %q: UpdateSnippet: %v\n", after.Name, err)
+		}
+	}
+	Info.Printf("VCL snippet %q updated\n", after.Name)
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version,
+		Resource:  "snippet",
+		Name:      after.Name,
+		Action:    "update",
+		Before:    before,
+		After:     after,
+	})
+}
+
+// updateSyslog brings an existing logging endpoint in line with the config
+func updateSyslog(client *fastly.Client, serviceID, name, address string, port uint, tlsCACert, tlsHostname, format string, before interface{}, after interface{}, version int) {
+	_, err := client.UpdateSyslog(&fastly.UpdateSyslogInput{
+		Service:     serviceID,
+		Version:     version,
+		Name:        name,
+		Address:     address,
+		Port:        port,
+		TLSCACert:   tlsCACert,
+		TLSHostname: tlsHostname,
+		Format:      format,
+	})
+	if err != nil {
+		Error.Fatalf("Cannot update logging endpoint %q: UpdateSyslog: %v\n", name, err)
+	}
+	Info.Printf("Logging endpoint %q updated\n", name)
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version,
+		Resource:  "syslog",
+		Name:      name,
+		Action:    "update",
+		Before:    before,
+		After:     after,
+	})
+}
+
+// reconcileVersioned applies the versioned objects of the source setup to a draft version of the target
+func reconcileVersioned(client *fastly.Client, serviceID string, src, dst TOMLConfig, waf *fastly.WAF, version int, withPX bool) {
+	switch {
+	case src.Prefetch.Name == "":
+	case dst.Prefetch.Name != src.Prefetch.Name:
+		prefetchCondition(client, serviceID, src, version)
+	case dst.Prefetch != src.Prefetch:
+		updatePrefetchCondition(client, serviceID, dst.Prefetch, src.Prefetch, version)
+	}
+
+	switch {
+	case src.Response.Name == "":
+	case dst.Response.Name != src.Response.Name:
+		responseObject(client, serviceID, src, version)
+	case dst.Response != src.Response:
+		updateResponseObject(client, serviceID, dst.Response, src.Response, version)
+	}
+
+	dstSnippets := configSnippets(dst)
+	for name, s := range configSnippets(src) {
+		existing, ok := dstSnippets[name]
+		switch {
+		case !ok:
+			vclSnippet(client, serviceID, s, version)
+		case existing != s:
+			updateVCLSnippet(client, serviceID, existing, s, version)
+		}
+	}
+
+	//create missing logging endpoints, existing ones are skipped and updated below
+	if (src.Weblog.Name != "" && dst.Weblog.Name != src.Weblog.Name) || (src.Waflog.Name != "" && dst.Waflog.Name != src.Waflog.Name) {
+		fastlyLogging(client, serviceID, src, version)
+	}
+	if src.Weblog.Name != "" && dst.Weblog.Name == src.Weblog.Name && dst.Weblog != src.Weblog {
+		w := src.Weblog
+		updateSyslog(client, serviceID, w.Name, w.Address, w.Port, w.Tlscacert, w.Tlshostname, w.Format, dst.Weblog, w, version)
+	}
+	if src.Waflog.Name != "" && dst.Waflog.Name == src.Waflog.Name && dst.Waflog != src.Waflog {
+		w := src.Waflog
+		updateSyslog(client, serviceID, w.Name, w.Address, w.Port, w.Tlscacert, w.Tlshostname, w.Format, dst.Waflog, w, version)
+	}
+	if src.Weblog.Name != "" && dst.Weblog != src.Weblog {
+		AddLoggingCondition(client, serviceID, version, src, withPX)
+	}
+
+	//point the WAF at the source prefetch condition and response object
+	if waf.PrefetchCondition != src.Prefetch.Name || waf.Response != src.Response.Name {
+		_, err := client.UpdateWAF(&fastly.UpdateWAFInput{
+			Service:           serviceID,
+			Version:           version,
+			ID:                waf.ID,
+			PrefetchCondition: src.Prefetch.Name,
+			Response:          src.Response.Name,
+		})
+		if err != nil {
+			Error.Fatalf("Cannot update WAF %q: UpdateWAF: %v\n", waf.ID, err)
+		}
+		Info.Printf("WAF %q updated\n", waf.ID)
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			WAFID:     waf.ID,
+			Version:   version,
+			Resource:  "waf",
+			Name:      waf.ID,
+			Action:    "update",
+			Before: map[string]string{
+				"prefetch_condition": waf.PrefetchCondition,
+				"response":           waf.Response,
+			},
+			After: map[string]string{
+				"prefetch_condition": src.Prefetch.Name,
+				"response":           src.Response.Name,
+			},
+		})
+	}
+}
+
+// completeNewWAF fills the prefetch condition, response object and VCL snippet a new WAF needs from the
+// local config when the source service has none, and reports the ones neither of them has
+func completeNewWAF(src *TOMLConfig, config TOMLConfig) bool {
+	if src.Prefetch.Name == "" && config.Prefetch.Name != "" {
+		Warning.Printf("Source service has no prefetch condition, using %q from the config\n", config.Prefetch.Name)
+		src.Prefetch = config.Prefetch
+	}
+	if src.Response.Name == "" && config.Response.Name != "" {
+		Warning.Printf("Source service has no response object, using %q from the config\n", config.Response.Name)
+		src.Response = config.Response
+	}
+	if src.Vclsnippet.Name == "" && config.Vclsnippet.Name != "" {
+		Warning.Printf("Source service has no snippet setting fastly-soc-x-request-id, using %q from the config\n", config.Vclsnippet.Name)
+		src.Vclsnippet = config.Vclsnippet
+	}
+
+	var missing []string
+	if src.Prefetch.Name == "" {
+		missing = append(missing, "prefetch condition")
+	}
+	if src.Response.Name == "" {
+		missing = append(missing, "response object")
+	}
+	if src.Vclsnippet.Name == "" {
+		missing = append(missing, "VCL snippet")
+	}
+	if len(missing) > 0 {
+		Error.Printf("Cannot provision a WAF on the target, neither the source service nor the config has a %s\n", strings.Join(missing, ", "))
+		return false
+	}
+	return true
+}
+
+// copyWAF reads the WAF setup of a source service and provisions or reconciles the target service to match
+// it, after showing the changes and getting confirmation. Versioned changes go to the draft picked by
+// serviceVersion, or a clone of the active version with the given comment.
+func copyWAF(client *fastly.Client, config TOMLConfig, apiKey, fromService, fromWAF, toService, toWAF string, activeVersion int, serviceVersion, comment string, omitLogs, withPX, yes bool) bool {
+
+	//read the source setup from its active version
+	srcVersion := getActiveVersion(client, fromService)
+	srcWAFs, err := client.ListWAFs(&fastly.ListWAFsInput{
+		Service: fromService,
+		Version: srcVersion,
+	})
+	if err != nil {
+		Error.Printf("Cannot list WAFs of service %q: ListWAFs: %v\n", fromService, err)
+		return false
+	}
+	if len(srcWAFs) == 0 {
+		Error.Printf("No WAF found on source service %s version %d\n", fromService, srcVersion)
+		return false
+	}
+	srcSelected, ok := selectWAFs(srcWAFs, fromWAF, false)
+	if !ok {
+		Error.Println("Pick the source WAF with --copy-from-waf")
+		return false
+	}
+	srcWAF := srcSelected[0]
+
+	Info.Printf("Reading WAF %s from service %s version %d\n", srcWAF.ID, fromService, srcVersion)
+	src, srcStatuses, ok := collectConfig(client, config.APIEndpoint, apiKey, fromService, srcWAF, srcVersion)
+	if !ok {
+		return false
+	}
+	srcSet := ""
+	if srcWAF.ConfigurationSet != nil {
+		srcSet = srcWAF.ConfigurationSet.ID
+	}
+
+	//read the target setup, a missing WAF is provisioned
+	dstWAFs, err := client.ListWAFs(&fastly.ListWAFsInput{
+		Service: toService,
+		Version: activeVersion,
+	})
+	if err != nil {
+		Error.Printf("Cannot list WAFs of service %q: ListWAFs: %v\n", toService, err)
+		return false
+	}
+
+	var dstWAF *fastly.WAF
+	dst := TOMLConfig{}
+	dstStatuses := make(map[string]string)
+	dstSet := ""
+	if len(dstWAFs) > 0 {
+		dstSelected, ok := selectWAFs(dstWAFs, toWAF, false)
+		if !ok {
+			return false
+		}
+		dstWAF = dstSelected[0]
+
+		Info.Printf("Reading WAF %s from service %s version %d\n", dstWAF.ID, toService, activeVersion)
+		dst, dstStatuses, ok = collectConfig(client, config.APIEndpoint, apiKey, toService, dstWAF, activeVersion)
+		if !ok {
+			return false
+		}
+		if dstWAF.ConfigurationSet != nil {
+			dstSet = dstWAF.ConfigurationSet.ID
+		}
+	}
+
+	//a new WAF needs all of its objects before a draft is touched
+	if dstWAF == nil && !completeNewWAF(&src, config) {
+		return false
+	}
+
+	//work out and show the changes
+	versioned := versionedChanges(src, dst)
+	var changes []wafSetupChange
+	if dstWAF == nil {
+		changes = append(changes, wafSetupChange{Object: "waf", Before: "-", After: "create"})
+	}
+	changes = append(changes, versioned...)
+	if srcSet != "" && srcSet != dstSet {
+		changes = append(changes, wafSetupChange{Object: "configuration_set", Before: shortValue(dstSet), After: shortValue(srcSet)})
+	}
+	changes = append(changes, fieldChanges("owasp", dst.Owasp, src.Owasp)...)
+	rulesChanged, grouped := ruleChanges(srcStatuses, dstStatuses)
+	changes = append(changes, rulesChanged...)
+
+	if len(changes) == 0 {
+		Info.Printf("WAF on service %s already matches service %s, nothing to do\n", toService, fromService)
+		return true
+	}
+
+	Info.Printf("Copying the WAF from service %s to %s makes %d change(s):\n", fromService, toService, len(changes))
+	for _, c := range changes {
+		fmt.Printf("  %-48s %s -> %s\n", c.Object, c.Before, c.After)
+	}
+
+	if !yes && !confirm(fmt.Sprintf("Apply these changes to service %s?", toService)) {
+		Warning.Println("Copy cancelled, no changes made")
+		return false
+	}
+
+	//versioned objects go to a draft version
+	version := 0
+	var wafID string
+	switch {
+	case dstWAF == nil:
+		version = draftVersion(client, toService, activeVersion, serviceVersion, comment)
+		wafID = provisionWAF(client, toService, src, version, nil, omitLogs, withPX)
+
+		//rules of the new WAF start from its defaults
+		current, ok := getRuleStatuses(config.APIEndpoint, apiKey, toService, wafID)
+		if !ok {
+			return false
+		}
+		_, grouped = ruleChanges(srcStatuses, current)
+
+	case len(versioned) > 0:
+		wafID = dstWAF.ID
+		version = draftVersion(client, toService, activeVersion, serviceVersion, comment)
+		reconcileVersioned(client, toService, src, dst, dstWAF, version, withPX)
+
+	default:
+		wafID = dstWAF.ID
+	}
+
+	//versionless changes
+	if srcSet != "" && srcSet != dstSet {
+		setConfigurationSet(wafID, dstSet, srcSet, client)
+	}
+	if dstWAF != nil && dst.Owasp != src.Owasp {
+		createOWASP(client, toService, src, wafID, nil)
+	}
+	for status, ids := range grouped {
+		Info.Printf("Setting %d rule(s) to %s\n", len(ids), status)
+		c := src
+		c.Rules = ids
+		c.Action = status
+		rulesConfig(config.APIEndpoint, apiKey, toService, wafID, c)
+	}
+
+	result := true
+	if PatchRules(toService, wafID, client, apiKey) {
+		Info.Println("Rule set successfully patched")
+	} else {
+		Error.Println("Issue patching ruleset see above error..")
+		result = false
+	}
+
+	if version != 0 {
+		result = finishVersion(client, toService, activeVersion, version, src) && result
+	}
+	return result
+}
@@ -0,0 +1,65 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleChanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		src         map[string]string
+		dst         map[string]string
+		wantChanges []wafSetupChange
+		wantGrouped map[string][]int64
+	}{
+		{
+			name:        "same rules",
+			src:         map[string]string{"931100": "log", "931110": "block"},
+			dst:         map[string]string{"931100": "log", "931110": "block"},
+			wantGrouped: map[string][]int64{},
+		},
+		{
+			name: "rules the target lacks or has in another status",
+			src:  map[string]string{"931100": "log", "931110": "block", "942100": "disabled"},
+			dst:  map[string]string{"931100": "block"},
+			wantChanges: []wafSetupChange{
+				{Object: "rule 931100", Before: "block", After: "log"},
+				{Object: "rule 931110", Before: "-", After: "block"},
+				{Object: "rule 942100", Before: "-", After: "disabled"},
+			},
+			wantGrouped: map[string][]int64{"log": {931100}, "block": {931110}, "disabled": {942100}},
+		},
+		{
+			name: "rules only the target has are disabled",
+			src:  map[string]string{"931100": "log"},
+			dst:  map[string]string{"931100": "log", "931110": "block", "942100": "disabled"},
+			wantChanges: []wafSetupChange{
+				{Object: "rule 931110", Before: "block", After: "disabled"},
+			},
+			wantGrouped: map[string][]int64{"disabled": {931110}},
+		},
+		{
+			name:        "invalid rule ID",
+			src:         map[string]string{"abc": "log"},
+			dst:         map[string]string{},
+			wantGrouped: map[string][]int64{},
+		},
+	}
+
+	for _, tt := range tests {
+		changes, grouped := ruleChanges(tt.src, tt.dst)
+		if !reflect.DeepEqual(changes, tt.wantChanges) {
+			t.Errorf("%s: ruleChanges() changes = %+v, want %+v", tt.name, changes, tt.wantChanges)
+		}
+		if !reflect.DeepEqual(grouped, tt.wantGrouped) {
+			t.Errorf("%s: ruleChanges() grouped = %v, want %v", tt.name, grouped, tt.wantGrouped)
+		}
+	}
+}
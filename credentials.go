@@ -0,0 +1,216 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// keyringService is the service name the API keys are filed under in the OS keyring
+const keyringService = "waflyctl"
+
+// helperAPIKey runs a credential helper the way git does: the request goes to its stdin as
+// key=value lines and the token is read from the password= line of its output. A helper that
+// only prints the token is fine as well.
+func helperAPIKey(command, apiEndpoint string) (string, bool) {
+	host := apiEndpoint
+	if u, err := url.Parse(apiEndpoint); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\n\n", host))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		Error.Printf("Credential helper %q failed: %v\n", command, err)
+		return "", false
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+		if strings.HasPrefix(line, "password=") {
+			return strings.TrimPrefix(line, "password="), true
+		}
+	}
+	if len(lines) == 1 && !strings.Contains(lines[0], "=") {
+		return lines[0], true
+	}
+
+	Error.Printf("Credential helper %q did not return a password= line\n", command)
+	return "", false
+}
+
+// fileAPIKey reads the API key from a file only its owner can access
+func fileAPIKey(kpath string) (string, bool) {
+	info, err := os.Stat(kpath)
+	if err != nil {
+		Error.Printf("Cannot read token file: %v\n", err)
+		return "", false
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		Error.Printf("Token file %s can be read by other users (mode %04o), restrict it with: chmod 600 %s\n", kpath, info.Mode().Perm(), kpath)
+		return "", false
+	}
+
+	b, err := ioutil.ReadFile(kpath)
+	if err != nil {
+		Error.Printf("Cannot read token file: %v\n", err)
+		return "", false
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		Error.Printf("Token file %s is empty\n", kpath)
+		return "", false
+	}
+	return key, true
+}
+
+// keyringAccount is the OS keyring account of a profile
+func keyringAccount(profile Profile) string {
+	if profile.Name == "" {
+		return "default"
+	}
+	return profile.Name
+}
+
+// keyringCommand builds the command of the platform keyring: the macOS keychain through
+// security and the Secret Service (GNOME Keyring, KWallet) through secret-tool on Linux
+func keyringCommand(save bool, account string) (*exec.Cmd, bool) {
+	switch runtime.GOOS {
+	case "darwin":
+		if save {
+			//without a value -w reads the password from stdin instead of the process arguments
+			return exec.Command("security", "add-generic-password", "-U", "-s", keyringService, "-a", account, "-w"), true
+		}
+		return exec.Command("security", "find-generic-password", "-s", keyringService, "-a", account, "-w"), true
+	case "linux":
+		if save {
+			return exec.Command("secret-tool", "store", "--label", fmt.Sprintf("%s API key (%s)", keyringService, account), "service", keyringService, "account", account), true
+		}
+		return exec.Command("secret-tool", "lookup", "service", keyringService, "account", account), true
+	}
+
+	Error.Printf("No OS keyring support on %s, use --token-helper or --token-file instead\n", runtime.GOOS)
+	return nil, false
+}
+
+// keyringAPIKey reads the API key of the profile from the OS keyring
+func keyringAPIKey(profile Profile) (string, bool) {
+	cmd, ok := keyringCommand(false, keyringAccount(profile))
+	if !ok {
+		return "", false
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		Error.Printf("OS keyring has no API key for %q, save it with --save-token: %v\n", keyringAccount(profile), err)
+		return "", false
+	}
+
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		Error.Printf("OS keyring has no API key for %q, save it with --save-token\n", keyringAccount(profile))
+		return "", false
+	}
+	return key, true
+}
+
+// saveAPIKey stores the API key of the profile in the OS keyring
+func saveAPIKey(profile Profile, key string) bool {
+	cmd, ok := keyringCommand(true, keyringAccount(profile))
+	if !ok {
+		return false
+	}
+	//security asks for the password twice when it reads it from a terminal
+	cmd.Stdin = strings.NewReader(key + "\n" + key + "\n")
+	if runtime.GOOS == "linux" {
+		cmd.Stdin = strings.NewReader(key)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		Error.Printf("Cannot save the API key to the OS keyring: %v\n", err)
+		return false
+	}
+
+	Info.Printf("API key for %q saved to the OS keyring\n", keyringAccount(profile))
+	return true
+}
+
+// resolveAPIKey finds the API key when none was given with --apikey or FASTLY_API_TOKEN. The
+// sources given on the command line come first, then the ones of the profile.
+func resolveAPIKey(profile Profile, helper, kpath string, keyring bool, apiEndpoint string) (string, bool) {
+	switch {
+	case helper != "":
+		return helperAPIKey(helper, apiEndpoint)
+	case kpath != "":
+		return fileAPIKey(kpath)
+	case keyring:
+		return keyringAPIKey(profile)
+	case profile.APIKeyEnv != "" && os.Getenv(profile.APIKeyEnv) != "":
+		return os.Getenv(profile.APIKeyEnv), true
+	case profile.APIKeyHelper != "":
+		return helperAPIKey(profile.APIKeyHelper, apiEndpoint)
+	case profile.APIKeyFile != "":
+		return fileAPIKey(profile.APIKeyFile)
+	case profile.APIKeyKeyring:
+		return keyringAPIKey(profile)
+	}
+
+	if profile.APIKeyEnv != "" {
+		Warning.Printf("Environment variable %s of the profile is empty\n", profile.APIKeyEnv)
+	}
+	return profile.APIKey, true
+}
+
+// apiKeyOnCommandLine tells whether the API key was passed as an argument, where it ends up
+// in shell history and process listings
+func apiKeyOnCommandLine(args []string) bool {
+	for _, arg := range args {
+		if arg == "--apikey" || strings.HasPrefix(arg, "--apikey=") {
+			return true
+		}
+	}
+	return false
+}
+
+// reportToken shows the scope and expiry of the API token before changes are made
+func reportToken(client *fastly.Client) (*fastly.Token, bool) {
+	token, err := client.GetTokenSelf()
+	if err != nil {
+		Error.Printf("Cannot read the API token details, it may be expired or invalid: GetTokenSelf: %v\n", err)
+		return nil, false
+	}
+
+	expiry := "never"
+	if token.ExpiresAt != nil {
+		expiry = token.ExpiresAt.UTC().Format(time.RFC1123)
+		if time.Until(*token.ExpiresAt) < 7*24*time.Hour {
+			Warning.Printf("API token %q expires on %s\n", token.Name, expiry)
+		}
+	}
+	services := "all services"
+	if len(token.Services) > 0 {
+		services = strings.Join(token.Services, ", ")
+	}
+
+	Info.Printf("API token %q scope: %s, expires: %s, services: %s\n", token.Name, token.Scope, expiry, services)
+	return token, true
+}
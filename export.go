@@ -0,0 +1,312 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// wafSnippetPattern matches VCL snippets that belong to a WAF setup
+var wafSnippetPattern = regexp.MustCompile(`(?i)waf|fastly-soc`)
+
+// exportRules expresses rule statuses as the action, rules and disabledrules of a config file. Rules in
+// the less common of log and block are returned separately for the provisioning settings.
+func exportRules(statuses map[string]string) (string, []int64, []int64, []int64) {
+	byStatus := make(map[string][]int64)
+	for id, status := range statuses {
+		ruleID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			Error.Printf("Failed to parse rule as int %s\n", id)
+			continue
+		}
+		byStatus[status] = append(byStatus[status], ruleID)
+	}
+	for _, ids := range byStatus {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+
+	action, other := "log", "block"
+	if len(byStatus["block"]) > len(byStatus["log"]) {
+		action, other = "block", "log"
+	}
+	return action, byStatus[action], byStatus["disabled"], byStatus[other]
+}
+
+// loggingExpiryPattern matches the expiry clause AddLoggingCondition adds to the logging condition
+var loggingExpiryPattern = regexp.MustCompile(`^\(std\.atoi\(now\.sec\) < (\d+)\)$`)
+
+// parseLoggingCondition splits a logging condition written by AddLoggingCondition into the web log
+// condition, the PerimeterX clause and the days left until the expiry. expired is set when the
+// condition has an expiry that already passed.
+func parseLoggingCondition(statement string, now time.Time) (string, bool, uint, bool) {
+	var perimeterX, expired bool
+	var expiry uint
+
+	parts := strings.Split(statement, " && ")
+	for len(parts) > 1 {
+		last := strings.TrimSpace(parts[len(parts)-1])
+		if last == "(req.http.x-request-id)" {
+			perimeterX = true
+		} else if m := loggingExpiryPattern.FindStringSubmatch(last); m != nil {
+			until, _ := strconv.ParseInt(m[1], 10, 64)
+			if left := until - now.Unix(); left > 0 {
+				expiry = uint((left + 24*60*60 - 1) / (24 * 60 * 60))
+			} else {
+				expired = true
+			}
+		} else {
+			break
+		}
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, " && "), perimeterX, expiry, expired
+}
+
+// exportSyslogs fills the web and WAF log settings from the syslog endpoints of a version
+func exportSyslogs(client *fastly.Client, serviceID string, version int, config *TOMLConfig) bool {
+	syslogs, err := client.ListSyslogs(&fastly.ListSyslogsInput{
+		Service: serviceID,
+		Version: version,
+	})
+	if err != nil {
+		Error.Printf("Cannot list logging endpoints: ListSyslogs: %v\n", err)
+		return false
+	}
+
+	for _, s := range syslogs {
+		switch {
+		case s.Placement == "waf_debug":
+			config.Waflog = WaflogSettings{
+				Name:        s.Name,
+				Address:     s.Address,
+				Port:        s.Port,
+				Tlscacert:   s.TLSCACert,
+				Tlshostname: s.TLSHostname,
+				Format:      s.Format,
+			}
+			Info.Printf("Reading WAF log endpoint %q\n", s.Name)
+
+		case strings.HasPrefix(s.ResponseCondition, "waf-soc-logging"):
+			config.Weblog = WeblogSettings{
+				Name:        s.Name,
+				Address:     s.Address,
+				Port:        s.Port,
+				Tlscacert:   s.TLSCACert,
+				Tlshostname: s.TLSHostname,
+				Format:      s.Format,
+			}
+
+			cond, err := client.GetCondition(&fastly.GetConditionInput{
+				Service: serviceID,
+				Version: version,
+				Name:    s.ResponseCondition,
+			})
+			if err != nil {
+				Warning.Printf("Cannot read logging condition %q: GetCondition: %v\n", s.ResponseCondition, err)
+			} else {
+				c, perimeterX, expiry, expired := parseLoggingCondition(cond.Statement, time.Now())
+				if c != "waf.executed" {
+					config.Weblog.Condition = c
+				}
+				config.Weblog.PerimeterX = perimeterX
+				config.Weblog.Expiry = expiry
+				if expired {
+					Warning.Printf("Web log %q expired, its expiry is left out of the config\n", s.Name)
+				}
+			}
+			Info.Printf("Reading web log endpoint %q\n", s.Name)
+		}
+	}
+	return true
+}
+
+// exportSnippets fills the VCL snippet settings from the WAF related snippets of a version
+func exportSnippets(client *fastly.Client, serviceID string, version int, config *TOMLConfig) bool {
+	snippets, err := client.ListSnippets(&fastly.ListSnippetsInput{
+		Service: serviceID,
+		Version: version,
+	})
+	if err != nil {
+		Error.Printf("Cannot list VCL snippets: ListSnippets: %v\n", err)
+		return false
+	}
+
+	for _, s := range snippets {
+		content := s.Content
+		if s.Dynamic == 1 {
+			dynamic, err := client.GetDynamicSnippet(&fastly.GetDynamicSnippetInput{
+				Service: serviceID,
+				ID:      s.ID,
+			})
+			if err != nil {
+				Warning.Printf("Cannot read dynamic snippet %q: GetDynamicSnippet: %v\n", s.Name, err)
+			} else {
+				content = dynamic.Content
+			}
+		}
+
+		if !wafSnippetPattern.MatchString(s.Name) && !wafSnippetPattern.MatchString(content) {
+			continue
+		}
+
+		snippet := VCLSnippetSettings{
+			Name:     s.Name,
+			Content:  content,
+			Type:     s.Type,
+			Priority: s.Priority,
+			Dynamic:  s.Dynamic,
+		}
+
+		//the snippet setting the request ID is the one waflyctl manages itself
+		if config.Vclsnippet.Name == "" && strings.Contains(content, "fastly-soc-x-request-id") {
+			config.Vclsnippet = snippet
+		} else {
+			if config.AdditionalSnippets == nil {
+				config.AdditionalSnippets = make(map[string]VCLSnippetSettings)
+			}
+			config.AdditionalSnippets[s.Name] = snippet
+		}
+		Info.Printf("Reading VCL snippet %q\n", s.Name)
+	}
+	return true
+}
+
+// collectConfig reads the WAF setup of a service into a config and returns it with the rule statuses.
+// Rules are left out of the config since a config file holds a single action.
+func collectConfig(client *fastly.Client, apiEndpoint, apiKey, serviceID string, waf *fastly.WAF, version int) (TOMLConfig, map[string]string, bool) {
+	config := TOMLConfig{
+		Logpath:     "waflyctl.log",
+		APIEndpoint: apiEndpoint,
+	}
+
+	//rule statuses
+	statuses, ok := getRuleStatuses(apiEndpoint, apiKey, serviceID, waf.ID)
+	if !ok {
+		return config, statuses, false
+	}
+
+	//OWASP settings
+	owasp, err := client.GetOWASP(&fastly.GetOWASPInput{
+		Service: serviceID,
+		ID:      waf.ID,
+	})
+	if err != nil {
+		Error.Printf("Cannot read OWASP object of WAF %s: GetOWASP: %v\n", waf.ID, err)
+		return config, statuses, false
+	}
+	config.Owasp = owaspFromFastly(owasp)
+
+	//prefetch condition
+	if waf.PrefetchCondition != "" {
+		cond, err := client.GetCondition(&fastly.GetConditionInput{
+			Service: serviceID,
+			Version: version,
+			Name:    waf.PrefetchCondition,
+		})
+		if err != nil {
+			Error.Printf("Cannot read prefetch condition %q: GetCondition: %v\n", waf.PrefetchCondition, err)
+			return config, statuses, false
+		}
+		config.Prefetch = PrefetchSettings{
+			Name:      cond.Name,
+			Statement: cond.Statement,
+			Type:      cond.Type,
+			Priority:  cond.Priority,
+		}
+		Info.Printf("Reading prefetch condition %q\n", cond.Name)
+	}
+
+	//response object
+	if waf.Response != "" {
+		resp, err := client.GetResponseObject(&fastly.GetResponseObjectInput{
+			Service: serviceID,
+			Version: version,
+			Name:    waf.Response,
+		})
+		if err != nil {
+			Error.Printf("Cannot read response object %q: GetResponseObject: %v\n", waf.Response, err)
+			return config, statuses, false
+		}
+		config.Response = ResponseSettings{
+			Name:           resp.Name,
+			HTTPStatusCode: resp.Status,
+			HTTPResponse:   resp.Response,
+			ContentType:    resp.ContentType,
+			Content:        resp.Content,
+		}
+		Info.Printf("Reading response object %q\n", resp.Name)
+	}
+
+	if !exportSnippets(client, serviceID, version, &config) || !exportSyslogs(client, serviceID, version, &config) {
+		return config, statuses, false
+	}
+
+	return config, statuses, true
+}
+
+// exportConfig writes a config file that reproduces the WAF setup of a service with --provision
+func exportConfig(client *fastly.Client, apiEndpoint, apiKey, serviceID string, waf *fastly.WAF, version int, epath string) bool {
+
+	//validate the output path
+	d := filepath.Dir(epath)
+	if _, err := os.Stat(d); os.IsNotExist(err) {
+		Error.Printf("Output path does not exist: %s\n", d)
+		return false
+	}
+
+	config, statuses, ok := collectConfig(client, apiEndpoint, apiKey, serviceID, waf, version)
+	if !ok {
+		return false
+	}
+
+	action, enabled, disabled, other := exportRules(statuses)
+	config.Action = action
+	config.Rules = enabled
+	config.SchemaVersion = configSchemaVersion
+	config.Provisioning.DisabledRules = disabled
+	if action == "log" {
+		config.Provisioning.BlockRules = other
+	} else {
+		config.Provisioning.LogRules = other
+	}
+	Info.Printf("Exporting %d rule(s) in %s mode, %d in the other mode and %d disabled rule(s)\n", len(enabled), action, len(other), len(disabled))
+
+	//JSON has no comments, the header only goes in TOML and YAML files
+	buf := new(bytes.Buffer)
+	if configFormat(epath) != "json" {
+		fmt.Fprintf(buf, "# Exported by waflyctl from WAF %s on service %s version %d\n\n", waf.ID, serviceID, version)
+	}
+
+	escapeInterpolation(reflect.ValueOf(&config))
+	doc, err := encodeDocument(epath, config)
+	if err != nil {
+		Error.Println(err)
+		return false
+	}
+	buf.Write(doc)
+
+	err = ioutil.WriteFile(epath, buf.Bytes(), 0644)
+	if err != nil {
+		Error.Println(err)
+		return false
+	}
+
+	Info.Printf("Bytes written: %d to %s\n", buf.Len(), epath)
+	return true
+}
@@ -0,0 +1,91 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportRules(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     map[string]string
+		wantAction   string
+		wantRules    []int64
+		wantDisabled []int64
+		wantOther    []int64
+	}{
+		{
+			name:       "no rules",
+			statuses:   map[string]string{},
+			wantAction: "log",
+		},
+		{
+			name:         "mostly log",
+			statuses:     map[string]string{"931110": "log", "931100": "log", "1010010": "block", "942100": "disabled"},
+			wantAction:   "log",
+			wantRules:    []int64{931100, 931110},
+			wantDisabled: []int64{942100},
+			wantOther:    []int64{1010010},
+		},
+		{
+			name:       "mostly block",
+			statuses:   map[string]string{"931110": "block", "931100": "block", "1010010": "log"},
+			wantAction: "block",
+			wantRules:  []int64{931100, 931110},
+			wantOther:  []int64{1010010},
+		},
+		{
+			name:       "as many log as block",
+			statuses:   map[string]string{"931110": "block", "931100": "log"},
+			wantAction: "log",
+			wantRules:  []int64{931100},
+			wantOther:  []int64{931110},
+		},
+		{
+			name:       "invalid rule ID",
+			statuses:   map[string]string{"931100": "log", "abc": "block"},
+			wantAction: "log",
+			wantRules:  []int64{931100},
+		},
+	}
+
+	for _, tt := range tests {
+		action, rules, disabled, other := exportRules(tt.statuses)
+		if action != tt.wantAction || !reflect.DeepEqual(rules, tt.wantRules) || !reflect.DeepEqual(disabled, tt.wantDisabled) || !reflect.DeepEqual(other, tt.wantOther) {
+			t.Errorf("%s: exportRules() = %s, %v, %v, %v, want %s, %v, %v, %v", tt.name, action, rules, disabled, other, tt.wantAction, tt.wantRules, tt.wantDisabled, tt.wantOther)
+		}
+	}
+}
+
+func TestParseLoggingCondition(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tests := []struct {
+		statement      string
+		wantCondition  string
+		wantPerimeterX bool
+		wantExpiry     uint
+		wantExpired    bool
+	}{
+		{"waf.executed", "waf.executed", false, 0, false},
+		{"waf.executed && (req.http.x-request-id)", "waf.executed", true, 0, false},
+		{"waf.executed && (std.atoi(now.sec) < 1500864000)", "waf.executed", false, 10, false},
+		{"waf.executed && (std.atoi(now.sec) < 1500000001)", "waf.executed", false, 1, false},
+		{"waf.executed && (std.atoi(now.sec) < 1499999999)", "waf.executed", false, 0, true},
+		{"waf.executed && !req.http.Fastly-FF && (req.http.x-request-id) && (std.atoi(now.sec) < 1500086400)", "waf.executed && !req.http.Fastly-FF", true, 1, false},
+		{"(req.http.x-request-id)", "(req.http.x-request-id)", false, 0, false},
+	}
+
+	for _, tt := range tests {
+		condition, perimeterX, expiry, expired := parseLoggingCondition(tt.statement, now)
+		if condition != tt.wantCondition || perimeterX != tt.wantPerimeterX || expiry != tt.wantExpiry || expired != tt.wantExpired {
+			t.Errorf("parseLoggingCondition(%q) = %q, %v, %d, %v, want %q, %v, %d, %v", tt.statement, condition, perimeterX, expiry, expired, tt.wantCondition, tt.wantPerimeterX, tt.wantExpiry, tt.wantExpired)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// configFormat picks the file format from the extension: yaml for .yaml and .yml, json for
+// .json and toml for anything else
+func configFormat(fpath string) string {
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	default:
+		return "toml"
+	}
+}
+
+// normalizeTree turns a decoded YAML or JSON value into the types the TOML decoder produces
+func normalizeTree(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range t {
+			if e != nil {
+				m[fmt.Sprint(k)] = normalizeTree(e)
+			}
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range t {
+			if e != nil {
+				m[k] = normalizeTree(e)
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = normalizeTree(e)
+		}
+		return l
+	case int:
+		return int64(t)
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+// decodeTree reads a TOML, YAML or JSON document into a generic tree
+func decodeTree(fpath string, b []byte) (map[string]interface{}, error) {
+	tree := make(map[string]interface{})
+	switch configFormat(fpath) {
+	case "yaml":
+		var doc map[interface{}]interface{}
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", fpath, err)
+		}
+		tree = normalizeTree(doc).(map[string]interface{})
+	case "json":
+		var doc map[string]interface{}
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		if err := d.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", fpath, err)
+		}
+		tree = normalizeTree(doc).(map[string]interface{})
+	default:
+		if _, err := toml.Decode(string(b), &tree); err != nil {
+			return nil, fmt.Errorf("%s: %v", fpath, err)
+		}
+	}
+	return tree, nil
+}
+
+// encodeDocument writes a config, a backup or a generic tree in the format of the file path
+func encodeDocument(fpath string, v interface{}) ([]byte, error) {
+	switch configFormat(fpath) {
+	case "yaml":
+		return yaml.Marshal(v)
+	case "json":
+		b, err := json.MarshalIndent(v, "", "  ")
+		return append(b, '\n'), err
+	default:
+		buf := new(bytes.Buffer)
+		err := toml.NewEncoder(buf).Encode(v)
+		return buf.Bytes(), err
+	}
+}
+
+// convertConfig translates a config file to the format of the output path. Values are copied as
+// written, environment variables and includes are left for the converted file to resolve.
+func convertConfig(in, out string) bool {
+	b, err := ioutil.ReadFile(in)
+	if err != nil {
+		fmt.Println("Could not read config file -", err)
+		return false
+	}
+	tree, err := decodeTree(in, b)
+	if err != nil {
+		fmt.Println("Could not read config file -", err)
+		return false
+	}
+
+	doc, err := encodeDocument(out, tree)
+	if err != nil {
+		fmt.Println("Could not convert config file -", err)
+		return false
+	}
+	if err := ioutil.WriteFile(out, doc, 0600); err != nil {
+		fmt.Println("Could not write config file -", err)
+		return false
+	}
+
+	fmt.Printf("Converted %s (%s) to %s (%s), comments are not carried over\n", in, configFormat(in), out, configFormat(out))
+	return true
+}
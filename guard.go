@@ -0,0 +1,190 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fastly/go-fastly/fastly"
+	"gopkg.in/resty.v1"
+)
+
+// ruleGuard is the state captured before a rule change so it can be rolled back
+type ruleGuard struct {
+	Statuses map[string]string
+	Baseline wafTraffic
+	Sample   wafTrafficSampler
+}
+
+// getRuleStatuses returns the status of every rule on a WAF keyed by rule ID
+func getRuleStatuses(apiEndpoint, apiKey, serviceID, wafID string) (map[string]string, bool) {
+	statuses := make(map[string]string)
+
+	for currentpage, totalpages := 1, 1; currentpage <= totalpages; currentpage++ {
+
+		//set our API call
+		apiCall := fmt.Sprintf("%s/service/%s/wafs/%s/rule_statuses?page[number]=%d", apiEndpoint, serviceID, wafID, currentpage)
+
+		resp, err := resty.R().
+			SetHeader("Accept", "application/vnd.api+json").
+			SetHeader("Fastly-Key", apiKey).
+			SetHeader("Content-Type", "application/vnd.api+json").
+			Get(apiCall)
+
+		//check if we had an issue with our call
+		if err != nil {
+			Error.Println("Error with API call: " + apiCall)
+			Error.Println(resp.String())
+			return statuses, false
+		}
+
+		//unmarshal the response and extract the rule statuses
+		body := RuleList{}
+		json.Unmarshal([]byte(resp.String()), &body)
+
+		for _, r := range body.Data {
+			statuses[r.Attributes.ModsecRuleID] = r.Attributes.Status
+		}
+		totalpages = body.Meta.TotalPages
+	}
+
+	if len(statuses) == 0 {
+		Error.Println("No Fastly Rules found")
+		return statuses, false
+	}
+
+	return statuses, true
+}
+
+// captureRuleGuard snapshots rule statuses and the WAF blocked baseline ahead of a change to block,
+// the baseline averages the given number of stats samples taken interval apart.
+// A nil guard is returned when no guard window was requested.
+func captureRuleGuard(client *fastly.Client, apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig, window, interval time.Duration, samples int, source, rtEndpoint string) (*ruleGuard, bool) {
+	if window <= 0 || config.Action != "block" {
+		return nil, true
+	}
+
+	Info.Println("Capturing rule statuses and WAF blocked baseline before the change")
+
+	statuses, ok := getRuleStatuses(apiEndpoint, apiKey, serviceID, wafID)
+	if !ok {
+		return nil, false
+	}
+
+	sample, ok := newWAFTrafficSampler(client, apiKey, serviceID, source, rtEndpoint)
+	if !ok {
+		return nil, false
+	}
+
+	baseline := wafTraffic{}
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		t, err := sample()
+		if err != nil {
+			Error.Printf("Cannot read stats for service %q: %v\n", serviceID, err)
+			return nil, false
+		}
+		baseline.merge(t)
+	}
+	Info.Printf("Baseline WAF blocked rate: %.2f/s over %.0fs (%d rule statuses saved)\n", baseline.rate(baseline.Blocked), baseline.Seconds, len(statuses))
+
+	return &ruleGuard{Statuses: statuses, Baseline: baseline, Sample: sample}, true
+}
+
+// guardRuleChange watches WAF blocks for the guard window and restores the captured rule statuses when they spike
+func guardRuleChange(guard *ruleGuard, client *fastly.Client, apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig, window, interval time.Duration, multiple, minRate float64) bool {
+	if guard == nil {
+		return true
+	}
+
+	limit := guard.Baseline.rate(guard.Baseline.Blocked) * multiple
+	if limit < minRate {
+		limit = minRate
+	}
+	Info.Printf("Guarding the change for %s, reverting if WAF blocks go above %.2f/s\n", window, limit)
+
+	deadline := time.Now().Add(window)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		t, err := guard.Sample()
+		if err != nil {
+			Warning.Printf("Cannot read stats for service %q: %v\n", serviceID, err)
+			continue
+		}
+
+		blocked := t.rate(t.Blocked)
+		Info.Printf("WAF blocked rate: %.2f/s (limit %.2f/s)\n", blocked, limit)
+
+		if blocked > limit {
+			Error.Printf("WAF blocked rate %.2f/s is over %.1fx the baseline, reverting rule statuses\n", blocked, multiple)
+			if !revertRuleStatuses(guard.Statuses, client, apiEndpoint, apiKey, serviceID, wafID, config) {
+				Error.Printf("Could not restore the rule statuses of WAF %s, the change is still live and needs to be reverted by hand\n", wafID)
+			}
+			return false
+		}
+	}
+
+	Info.Println("Guard window passed without a block spike")
+	return true
+}
+
+// revertRuleStatuses puts every rule whose status changed back to its captured status and patches the ruleset
+func revertRuleStatuses(statuses map[string]string, client *fastly.Client, apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig) bool {
+	current, ok := getRuleStatuses(apiEndpoint, apiKey, serviceID, wafID)
+	if !ok {
+		return false
+	}
+
+	//group the changed rules by the status they need to go back to
+	changed := make(map[string][]int64)
+	for id, status := range statuses {
+		if current[id] == status {
+			continue
+		}
+		ruleID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			Error.Printf("Failed to parse rule as int %s\n", id)
+			continue
+		}
+		changed[status] = append(changed[status], ruleID)
+	}
+
+	if len(changed) == 0 {
+		Warning.Println("No rule statuses changed since the snapshot, nothing to revert")
+		return true
+	}
+
+	restored := true
+	for status, ids := range changed {
+		Info.Printf("Restoring %d rule(s) to %s\n", len(ids), status)
+		config.Rules = ids
+		config.Action = status
+		if updated := rulesConfig(apiEndpoint, apiKey, serviceID, wafID, config); len(updated) < len(ids) {
+			Error.Printf("%d rule(s) could not be restored to %s\n", len(ids)-len(updated), status)
+			restored = false
+		}
+	}
+
+	if !PatchRules(serviceID, wafID, client, apiKey) {
+		Error.Println("Issue patching ruleset see above error..")
+		return false
+	}
+
+	if !restored {
+		Info.Println("Rule set successfully patched")
+		return false
+	}
+
+	Info.Println("Rule set successfully patched with the previous rule statuses")
+	return true
+}
@@ -0,0 +1,264 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// JournalEntry records a single change made by waflyctl
+type JournalEntry struct {
+	Time        time.Time   `json:"time"`
+	RunID       string      `json:"run_id"`
+	Operator    string      `json:"operator"`
+	TokenID     string      `json:"token_id,omitempty"`
+	TokenName   string      `json:"token_name,omitempty"`
+	TokenUserID string      `json:"token_user_id,omitempty"`
+	ServiceID   string      `json:"service_id"`
+	WAFID       string      `json:"waf_id,omitempty"`
+	Version     int         `json:"version,omitempty"`
+	Resource    string      `json:"resource"`
+	Name        string      `json:"name,omitempty"`
+	Action      string      `json:"action"`
+	Before      interface{} `json:"before,omitempty"`
+	After       interface{} `json:"after,omitempty"`
+}
+
+// auditJournal holds the identity stamped on every entry of a run
+type auditJournal struct {
+	path      string
+	runID     string
+	operator  string
+	serviceID string
+	written   bool
+	client    *fastly.Client
+	token     *fastly.Token
+}
+
+// journal is the audit journal of the current run, nil when journaling is off
+var journal *auditJournal
+
+// openJournal starts a new run in the audit journal
+func openJournal(jpath, serviceID string, client *fastly.Client) {
+
+	//create a run ID
+	hasher := sha1.New()
+	hasher.Write([]byte(serviceID + time.Now().String()))
+	runID := hex.EncodeToString(hasher.Sum(nil))[:12]
+
+	operator := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		operator = u.Username
+	}
+
+	journal = &auditJournal{
+		path:      jpath,
+		runID:     runID,
+		operator:  operator,
+		serviceID: serviceID,
+		client:    client,
+	}
+}
+
+// recordChange appends an entry to the audit journal. Failures are reported but never stop the run.
+func recordChange(entry JournalEntry) {
+	if journal == nil {
+		return
+	}
+
+	//look up the token identity on the first change of the run only
+	if journal.token == nil && journal.client != nil {
+		token, err := journal.client.GetTokenSelf()
+		if err != nil {
+			Warning.Printf("Cannot identify API token for the audit journal: %v\n", err)
+			token = &fastly.Token{}
+		}
+		journal.token = token
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.RunID = journal.runID
+	entry.Operator = journal.operator
+	if journal.token != nil {
+		entry.TokenID = journal.token.ID
+		entry.TokenName = journal.token.Name
+		entry.TokenUserID = journal.token.UserID
+	}
+	if entry.ServiceID == "" {
+		entry.ServiceID = journal.serviceID
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		Warning.Printf("Cannot encode audit journal entry: %v\n", err)
+		return
+	}
+
+	file, err := os.OpenFile(journal.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		Warning.Printf("Cannot open audit journal %s: %v\n", journal.path, err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		Warning.Printf("Cannot write audit journal %s: %v\n", journal.path, err)
+		return
+	}
+
+	if !journal.written {
+		journal.written = true
+		Info.Printf("Changes of this run are journaled in %s with run ID %s\n", journal.path, journal.runID)
+	}
+}
+
+// readJournal loads every entry of the audit journal
+func readJournal(jpath string) ([]JournalEntry, bool) {
+	var entries []JournalEntry
+
+	file, err := os.Open(jpath)
+	if os.IsNotExist(err) {
+		return entries, true
+	}
+	if err != nil {
+		Error.Printf("Cannot open audit journal %s: %v\n", jpath, err)
+		return entries, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		entry := JournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			Warning.Printf("Skipping unreadable audit journal line %d: %v\n", n, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		Error.Printf("Cannot read audit journal %s: %v\n", jpath, err)
+		return entries, false
+	}
+
+	return entries, true
+}
+
+// parseHistoryDate accepts either a date or a full RFC 3339 timestamp
+func parseHistoryDate(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", value)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// formatJournalValue renders a before or after value on a single line
+func formatJournalValue(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// showHistory lists audit journal entries filtered by service, rule and date range
+func showHistory(jpath, serviceID, ruleID, since, until string) bool {
+	entries, ok := readJournal(jpath)
+	if !ok {
+		return false
+	}
+
+	var from, to time.Time
+	var err error
+	if since != "" {
+		if from, err = parseHistoryDate(since, false); err != nil {
+			Error.Println(err)
+			return false
+		}
+	}
+	if until != "" {
+		if to, err = parseHistoryDate(until, true); err != nil {
+			Error.Println(err)
+			return false
+		}
+	}
+
+	count := 0
+	for _, e := range entries {
+		if serviceID != "" && e.ServiceID != serviceID {
+			continue
+		}
+		if ruleID != "" && (e.Resource != "rule_status" || e.Name != ruleID) {
+			continue
+		}
+		if !from.IsZero() && e.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && e.Time.After(to) {
+			continue
+		}
+
+		count++
+		Info.Printf("- %s\tRun: %s\tOperator: %s\tService: %s\tWAF: %s\tVersion: %d\t%s %s %s\t%s -> %s\n",
+			e.Time.Format(time.RFC3339), e.RunID, e.Operator, e.ServiceID, e.WAFID, e.Version,
+			e.Action, e.Resource, e.Name, formatJournalValue(e.Before), formatJournalValue(e.After))
+	}
+
+	Info.Printf("%d journal entries found\n", count)
+	return true
+}
+
+// recordRuleStatus journals the status change of a single rule
+func recordRuleStatus(serviceID, wafID, ruleID, before, after string) {
+	entry := JournalEntry{
+		ServiceID: serviceID,
+		WAFID:     wafID,
+		Resource:  "rule_status",
+		Name:      ruleID,
+		Action:    "update",
+		After:     after,
+	}
+	if before != "" {
+		entry.Before = before
+	}
+	recordChange(entry)
+}
+
+// recordRuleStatusChanges journals every rule whose status differs between two snapshots
+func recordRuleStatusChanges(serviceID, wafID string, before, after map[string]string) {
+	for ruleID, status := range after {
+		if before[ruleID] != status {
+			recordRuleStatus(serviceID, wafID, ruleID, before[ruleID], status)
+		}
+	}
+}
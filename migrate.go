@@ -0,0 +1,211 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// configSchemaVersion is the schema version of the config this waflyctl reads, a config without
+// schema_version is version 1
+const configSchemaVersion = 2
+
+// configMigration upgrades a config tree from the version before To, it returns a note for
+// every deprecated setting it changed
+type configMigration struct {
+	To      int
+	Migrate func(tree map[string]interface{}) []string
+}
+
+// configMigrations are applied in order to the configs older than their version
+var configMigrations = []configMigration{
+	{2, migrateToV2},
+}
+
+// legacyConditions are the clauses older waflyctl versions had users add to the web log condition,
+// the clauses without a setting to move to are kept in the condition
+var legacyConditions = []struct {
+	Clause  string
+	Setting string
+	Note    string
+}{
+	{"req.http.x-request-id", "perimeterx", "the PerimeterX clause of weblog.condition moved to weblog.perimeterx, PerimeterX logging conditions will be removed in the next major release"},
+	{"!req.http.Fastly-FF", "", "weblog.condition keeps the shielding clause !req.http.Fastly-FF of older waflyctl versions, without it shield and edge both log every request"},
+}
+
+// removeClause drops a clause from the top level && chain of a VCL condition
+func removeClause(condition, clause string) (string, bool) {
+	if strings.Contains(condition, "||") {
+		return condition, false
+	}
+	var kept []string
+	removed := false
+	for _, part := range strings.Split(condition, "&&") {
+		p := strings.TrimSpace(part)
+		if strings.EqualFold(strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(p, "("), ")")), clause) {
+			removed = true
+			continue
+		}
+		kept = append(kept, p)
+	}
+	if !removed || len(kept) == 0 {
+		return condition, false
+	}
+	return strings.Join(kept, " && "), true
+}
+
+// migrateToV2 moves the settings that only apply to new WAFs to [provisioning], drops the
+// unused apiendpoint and moves the PerimeterX clause of the web log condition to its setting
+func migrateToV2(tree map[string]interface{}) []string {
+	var notes []string
+
+	k := configKey(tree, "disabledrules")
+	if rules, ok := tree[k]; ok {
+		delete(tree, k)
+		pk := configKey(tree, "provisioning")
+		provisioning, ok := tree[pk].(map[string]interface{})
+		if !ok {
+			provisioning = make(map[string]interface{})
+			tree[pk] = provisioning
+		}
+		provisioning["disabledrules"] = rules
+		notes = append(notes, "disabledrules moved to provisioning.disabledrules, the rules are only disabled when a new WAF is provisioned")
+	}
+
+	k = configKey(tree, "apiendpoint")
+	if _, ok := tree[k]; ok {
+		delete(tree, k)
+		notes = append(notes, "apiendpoint was removed, it was never read from the config, use --apiendpoint or the APIEndpoint of a profile")
+	}
+
+	weblog, ok := tree[configKey(tree, "weblog")].(map[string]interface{})
+	if !ok {
+		return notes
+	}
+	ck := configKey(weblog, "condition")
+	condition, ok := weblog[ck].(string)
+	if !ok {
+		return notes
+	}
+	for _, legacy := range legacyConditions {
+		c, removed := removeClause(condition, legacy.Clause)
+		if !removed {
+			continue
+		}
+		if legacy.Setting != "" {
+			condition = c
+			weblog[legacy.Setting] = true
+		}
+		notes = append(notes, legacy.Note)
+	}
+	weblog[ck] = condition
+	return notes
+}
+
+// migrateTree upgrades a decoded config file to the current schema version
+func migrateTree(tree map[string]interface{}, cpath string) ([]string, error) {
+	version := 1
+	k := configKey(tree, "schema_version")
+	if v, ok := tree[k]; ok {
+		n, ok := v.(int64)
+		if !ok || n < 1 {
+			return nil, fmt.Errorf("%s: schema_version must be a positive number", cpath)
+		}
+		version = int(n)
+	}
+	if version > configSchemaVersion {
+		return nil, fmt.Errorf("%s: schema_version %d is newer than this waflyctl supports (%d), upgrade waflyctl", cpath, version, configSchemaVersion)
+	}
+
+	var notes []string
+	for _, m := range configMigrations {
+		if m.To <= version {
+			continue
+		}
+		for _, n := range m.Migrate(tree) {
+			notes = append(notes, fmt.Sprintf("%s (schema version %d): %s", cpath, version, n))
+		}
+	}
+	delete(tree, k)
+	tree["schema_version"] = int64(configSchemaVersion)
+	return notes, nil
+}
+
+// migrateConfig rewrites a config file and the files it includes in the current schema, the old
+// files are kept with a .bak suffix. Values are kept as written, like --convert-config does.
+func migrateConfig(cpath string, seen map[string]bool) bool {
+	abs, err := filepath.Abs(cpath)
+	if err != nil {
+		fmt.Println("Could not read config file -", err)
+		return false
+	}
+	if seen[abs] {
+		fmt.Printf("Could not migrate config file - %s includes itself\n", cpath)
+		return false
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+
+	b, err := ioutil.ReadFile(cpath)
+	if err != nil {
+		fmt.Println("Could not read config file -", err)
+		return false
+	}
+	tree, err := decodeTree(cpath, b)
+	if err != nil {
+		fmt.Println("Could not read config file -", err)
+		return false
+	}
+
+	if includes, ok := tree[configKey(tree, "include")].([]interface{}); ok {
+		for _, i := range includes {
+			ipath, ok := i.(string)
+			if !ok {
+				continue
+			}
+			if !filepath.IsAbs(ipath) {
+				ipath = filepath.Join(filepath.Dir(cpath), ipath)
+			}
+			if !migrateConfig(ipath, seen) {
+				return false
+			}
+		}
+	}
+
+	if v, _ := tree[configKey(tree, "schema_version")].(int64); v == configSchemaVersion {
+		fmt.Printf("%s is up to date\n", cpath)
+		return true
+	}
+	notes, err := migrateTree(tree, cpath)
+	if err != nil {
+		fmt.Println("Could not migrate config file -", err)
+		return false
+	}
+	for _, n := range notes {
+		fmt.Println(n)
+	}
+
+	doc, err := encodeDocument(cpath, tree)
+	if err != nil {
+		fmt.Println("Could not migrate config file -", err)
+		return false
+	}
+	if err := ioutil.WriteFile(cpath+".bak", b, 0600); err != nil {
+		fmt.Println("Could not back up config file -", err)
+		return false
+	}
+	if err := ioutil.WriteFile(cpath, doc, 0600); err != nil {
+		fmt.Println("Could not write config file -", err)
+		return false
+	}
+
+	fmt.Printf("Migrated %s to schema version %d, the old file is %s.bak and comments are not carried over\n", cpath, configSchemaVersion, cpath)
+	return true
+}
@@ -0,0 +1,106 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemoveClause(t *testing.T) {
+	tests := []struct {
+		condition string
+		clause    string
+		want      string
+		removed   bool
+	}{
+		{"waf.executed && (req.http.x-request-id)", "req.http.x-request-id", "waf.executed", true},
+		{"waf.executed && !req.http.Fastly-FF", "!req.http.fastly-ff", "waf.executed", true},
+		{"waf.executed", "req.http.x-request-id", "waf.executed", false},
+		{"req.http.x-request-id", "req.http.x-request-id", "req.http.x-request-id", false},
+		{"waf.executed || req.http.x-request-id", "req.http.x-request-id", "waf.executed || req.http.x-request-id", false},
+	}
+
+	for _, tt := range tests {
+		got, removed := removeClause(tt.condition, tt.clause)
+		if got != tt.want || removed != tt.removed {
+			t.Errorf("removeClause(%q, %q) = %q, %v, want %q, %v", tt.condition, tt.clause, got, removed, tt.want, tt.removed)
+		}
+	}
+}
+
+func TestMigrateTree(t *testing.T) {
+	tests := []struct {
+		name    string
+		tree    map[string]interface{}
+		want    map[string]interface{}
+		notes   int
+		wantErr bool
+	}{
+		{
+			name: "version 1",
+			tree: map[string]interface{}{
+				"action":        "log",
+				"DisabledRules": []interface{}{int64(1010010)},
+				"apiendpoint":   "https://api.fastly.com",
+				"weblog": map[string]interface{}{
+					"condition": "waf.executed && req.http.x-request-id && !req.http.Fastly-FF",
+				},
+			},
+			want: map[string]interface{}{
+				"action": "log",
+				"provisioning": map[string]interface{}{
+					"disabledrules": []interface{}{int64(1010010)},
+				},
+				"weblog": map[string]interface{}{
+					"condition":  "waf.executed && !req.http.Fastly-FF",
+					"perimeterx": true,
+				},
+				"schema_version": int64(configSchemaVersion),
+			},
+			notes: 4,
+		},
+		{
+			name: "current version",
+			tree: map[string]interface{}{
+				"schema_version": int64(configSchemaVersion),
+				"disabledrules":  []interface{}{int64(1010010)},
+			},
+			want: map[string]interface{}{
+				"schema_version": int64(configSchemaVersion),
+				"disabledrules":  []interface{}{int64(1010010)},
+			},
+		},
+		{
+			name:    "newer version",
+			tree:    map[string]interface{}{"schema_version": int64(configSchemaVersion + 1)},
+			wantErr: true,
+		},
+		{
+			name:    "invalid version",
+			tree:    map[string]interface{}{"schema_version": "2"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		notes, err := migrateTree(tt.tree, "waflyctl.toml")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: migrateTree() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(notes) != tt.notes {
+			t.Errorf("%s: migrateTree() notes = %q, want %d", tt.name, notes, tt.notes)
+		}
+		if !reflect.DeepEqual(tt.tree, tt.want) {
+			t.Errorf("%s: migrateTree() tree = %v, want %v", tt.name, tt.tree, tt.want)
+		}
+	}
+}
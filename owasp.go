@@ -0,0 +1,392 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// owaspPresets are named sets of OWASP settings, the keys of [owasp] win over the preset
+var owaspPresets = map[string]map[string]interface{}{
+	"balanced": {
+		"ParanoiaLevel":                int64(1),
+		"InboundAnomalyScoreThreshold": int64(10),
+		"CriticalAnomalyScore":         int64(5),
+		"ErrorAnomalyScore":            int64(4),
+		"WarningAnomalyScore":          int64(3),
+		"NoticeAnomalyScore":           int64(2),
+		"AllowedHTTPVersions":          "HTTP/1.0 HTTP/1.1 HTTP/2",
+		"AllowedMethods":               "GET HEAD POST OPTIONS PUT PATCH DELETE",
+		"ArgLength":                    int64(800),
+		"ArgNameLength":                int64(800),
+		"MaxNumArgs":                   int64(255),
+		"TotalArgLength":               int64(6400),
+		"MaxFileSize":                  int64(10000000),
+		"CombinedFileSizes":            int64(10000000),
+	},
+	"strict": {
+		"ParanoiaLevel":                int64(3),
+		"InboundAnomalyScoreThreshold": int64(5),
+		"CriticalAnomalyScore":         int64(5),
+		"ErrorAnomalyScore":            int64(4),
+		"WarningAnomalyScore":          int64(3),
+		"NoticeAnomalyScore":           int64(2),
+		"AllowedHTTPVersions":          "HTTP/1.1 HTTP/2",
+		"AllowedMethods":               "GET HEAD POST",
+		"ArgLength":                    int64(400),
+		"ArgNameLength":                int64(100),
+		"MaxNumArgs":                   int64(128),
+		"TotalArgLength":               int64(3200),
+		"MaxFileSize":                  int64(1000000),
+		"CombinedFileSizes":            int64(5000000),
+	},
+	"api-only": {
+		"ParanoiaLevel":                int64(2),
+		"InboundAnomalyScoreThreshold": int64(10),
+		"AllowedHTTPVersions":          "HTTP/1.1 HTTP/2",
+		"AllowedMethods":               "GET HEAD POST PUT PATCH DELETE OPTIONS",
+		"AllowedRequestContentType":    "application/json|application/x-www-form-urlencoded",
+		"ArgLength":                    int64(800),
+		"MaxNumArgs":                   int64(255),
+		"TotalArgLength":               int64(6400),
+		"MaxFileSize":                  int64(1000000),
+		"CombinedFileSizes":            int64(1000000),
+	},
+}
+
+// owaspSetting finds the OWASP setting field matching a name, names are not case sensitive
+func owaspSetting(name string) (reflect.StructField, bool) {
+	t := reflect.TypeOf(owaspSettings{})
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Name, name) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// owaspOverrides turns the KEY=VALUE pairs of --set into an [owasp] table for the command line layer
+func owaspOverrides(sets []string) (map[string]interface{}, error) {
+	table := make(map[string]interface{})
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("--set %q is not KEY=VALUE", set)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if strings.EqualFold(key, "preset") {
+			table["preset"] = value
+			continue
+		}
+
+		field, ok := owaspSetting(key)
+		if !ok {
+			return nil, fmt.Errorf("--set %s: not an OWASP setting", key)
+		}
+		switch field.Type.Kind() {
+		case reflect.Int:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("--set %s: %q is not a number", field.Name, value)
+			}
+			table[field.Name] = n
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("--set %s: %q is not true or false", field.Name, value)
+			}
+			table[field.Name] = b
+		default:
+			table[field.Name] = value
+		}
+	}
+	return table, nil
+}
+
+// applyOWASPPreset fills the OWASP settings the config leaves out from the preset it names
+func applyOWASPPreset(layered *layeredConfig) error {
+	k := configKey(layered.Tree, "owasp")
+	owasp, ok := layered.Tree[k].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	pk := configKey(owasp, "preset")
+	v, ok := owasp[pk]
+	if !ok {
+		return nil
+	}
+	delete(owasp, pk)
+	delete(layered.Sources, k+"."+pk)
+
+	presetName, _ := v.(string)
+	preset, ok := owaspPresets[presetName]
+	if !ok {
+		var names []string
+		for n := range owaspPresets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("OWASP preset %q is not one of: %s", v, strings.Join(names, ", "))
+	}
+	for name, value := range preset {
+		if _, set := owasp[configKey(owasp, name)]; set {
+			continue
+		}
+		owasp[name] = value
+		layered.Sources[k+"."+name] = "preset " + presetName
+	}
+	return nil
+}
+
+// owaspFields lists the OWASP settings present in the effective config, only those are sent to Fastly
+func owaspFields(layered layeredConfig) []string {
+	owasp, ok := layered.Tree[configKey(layered.Tree, "owasp")].(map[string]interface{})
+	if !ok {
+		return []string{}
+	}
+	fields := []string{}
+	for name := range owasp {
+		if field, ok := owaspSetting(name); ok {
+			fields = append(fields, field.Name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// owaspUpdate collects the given fields of the new OWASP settings that differ from the current ones
+// as JSON:API attributes and shows the old and new value of every change. All fields are used
+// when none are given. A field that was set keeps its value even when it is false or 0.
+func owaspUpdate(before, after owaspSettings, fields []string) map[string]interface{} {
+	if fields == nil {
+		t := reflect.TypeOf(after)
+		for i := 0; i < t.NumField(); i++ {
+			fields = append(fields, t.Field(i).Name)
+		}
+	}
+
+	b := reflect.ValueOf(before)
+	a := reflect.ValueOf(after)
+	input := reflect.TypeOf(fastly.UpdateOWASPInput{})
+	attributes := make(map[string]interface{})
+	var changes []wafSetupChange
+	for _, name := range fields {
+		bv := b.FieldByName(name).Interface()
+		av := a.FieldByName(name).Interface()
+		if reflect.DeepEqual(bv, av) {
+			continue
+		}
+		field, ok := input.FieldByName(name)
+		if !ok {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("jsonapi"), ",")
+		if len(tag) < 2 {
+			continue
+		}
+		attributes[tag[1]] = av
+		changes = append(changes, wafSetupChange{Object: "owasp " + name, Before: shortValue(bv), After: shortValue(av)})
+	}
+
+	if len(changes) > 0 {
+		Info.Printf("OWASP settings update makes %d change(s):\n", len(changes))
+		for _, c := range changes {
+			fmt.Printf("  %-48s %s -> %s\n", c.Object, c.Before, c.After)
+		}
+	}
+	return attributes
+}
+
+// updateOWASP patches the OWASP settings with the given attributes and reads them back. The API
+// client leaves out false and 0, so the JSON:API document is written here.
+func updateOWASP(client *fastly.Client, serviceID, wafID, owaspID string, attributes map[string]interface{}) (*fastly.OWASP, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":         owaspID,
+			"type":       "owasp",
+			"attributes": attributes,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Patch(fmt.Sprintf("/service/%s/wafs/%s/owasp", serviceID, wafID), &fastly.RequestOptions{
+		Headers: map[string]string{
+			"Accept":       "application/vnd.api+json",
+			"Content-Type": "application/vnd.api+json",
+		},
+		Body:       bytes.NewReader(body),
+		BodyLength: int64(len(body)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return client.GetOWASP(&fastly.GetOWASPInput{
+		Service: serviceID,
+		ID:      wafID,
+	})
+}
+
+// owaspListEdit adds or removes values of an OWASP list setting
+type owaspListEdit struct {
+	Field  string
+	Values []string
+	Remove bool
+}
+
+// normalizeListItem writes a value of an OWASP list setting the way its format expects, so
+// config, .config and .config/ are the same restricted extension
+func normalizeListItem(field, item string) (string, error) {
+	switch field {
+	case "RestrictedExtensions":
+		item = "." + strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(item, "."), "/")) + "/"
+	case "RestrictedHeaders":
+		item = "/" + strings.ToLower(strings.Trim(item, "/")) + "/"
+	case "AllowedMethods", "AllowedHTTPVersions":
+		item = strings.ToUpper(item)
+	default:
+		item = strings.ToLower(item)
+	}
+	format := owaspListFormats[field]
+	if !format.Item.MatchString(item) {
+		return item, fmt.Errorf("%s: %q does not fit the list format, expected something like %q", field, item, format.Example)
+	}
+	return item, nil
+}
+
+// splitList cuts a list setting into its normalized values without duplicates
+func splitList(field, value string) []string {
+	var items []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(value, owaspListFormats[field].Separator) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		//values Fastly holds that do not fit the format are kept as they are
+		if n, err := normalizeListItem(field, item); err == nil {
+			item = n
+		}
+		if !seen[item] {
+			seen[item] = true
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// owaspListEdits reads the SETTING=VALUES arguments of --owasp-add and --owasp-remove. Values
+// are separated by commas, spaces or the delimiter of the setting.
+func owaspListEdits(adds, removes []string) ([]owaspListEdit, error) {
+	var edits []owaspListEdit
+	for i, arg := range append(append([]string{}, adds...), removes...) {
+		remove := i >= len(adds)
+		flag := "--owasp-add"
+		if remove {
+			flag = "--owasp-remove"
+		}
+
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s %q is not SETTING=VALUES", flag, arg)
+		}
+		field, ok := owaspSetting(strings.TrimSpace(kv[0]))
+		if _, list := owaspListFormats[field.Name]; !ok || !list {
+			names := make([]string, 0, len(owaspListFormats))
+			for n := range owaspListFormats {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("%s %s: not one of the OWASP list settings %s", flag, kv[0], strings.Join(names, ", "))
+		}
+
+		separator := owaspListFormats[field.Name].Separator
+		edit := owaspListEdit{Field: field.Name, Remove: remove}
+		for _, v := range strings.FieldsFunc(kv[1], func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r) || string(r) == separator
+		}) {
+			item, err := normalizeListItem(field.Name, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s %v", flag, err)
+			}
+			edit.Values = append(edit.Values, item)
+		}
+		if len(edit.Values) == 0 {
+			return nil, fmt.Errorf("%s %s: no values given", flag, field.Name)
+		}
+		edits = append(edits, edit)
+	}
+	return edits, nil
+}
+
+// applyListEdits adds and removes values of the OWASP list settings, it returns the settings
+// after the edits and the names of the settings edited
+func applyListEdits(current owaspSettings, edits []owaspListEdit) (owaspSettings, []string) {
+	var fields []string
+	settings := reflect.ValueOf(&current).Elem()
+	for _, edit := range edits {
+		f := settings.FieldByName(edit.Field)
+		items := splitList(edit.Field, f.String())
+		for _, v := range edit.Values {
+			at := -1
+			for i, item := range items {
+				if item == v {
+					at = i
+				}
+			}
+			switch {
+			case edit.Remove && at < 0:
+				Warning.Printf("%s does not hold %q\n", edit.Field, v)
+			case edit.Remove:
+				items = append(items[:at], items[at+1:]...)
+			case at >= 0:
+				Info.Printf("%s already holds %q\n", edit.Field, v)
+			default:
+				items = append(items, v)
+			}
+		}
+		f.SetString(strings.Join(items, owaspListFormats[edit.Field].Separator))
+
+		known := false
+		for _, name := range fields {
+			known = known || name == edit.Field
+		}
+		if !known {
+			fields = append(fields, edit.Field)
+		}
+	}
+	return current, fields
+}
+
+// editOWASPLists updates only the OWASP list settings named by --owasp-add and --owasp-remove
+func editOWASPLists(client *fastly.Client, serviceID, wafID string, config TOMLConfig, edits []owaspListEdit) bool {
+	owasp, err := client.GetOWASP(&fastly.GetOWASPInput{
+		Service: serviceID,
+		ID:      wafID,
+	})
+	if err != nil || owasp.ID == "" {
+		Error.Printf("Cannot read the OWASP settings of WAF %s, create them with --owasp: GetOWASP: %v\n", wafID, err)
+		return false
+	}
+
+	c := config
+	var fields []string
+	c.Owasp, fields = applyListEdits(owaspFromFastly(owasp), edits)
+	createOWASP(client, serviceID, c, wafID, fields)
+	return true
+}
@@ -0,0 +1,97 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		field string
+		value string
+		want  []string
+	}{
+		{"RestrictedExtensions", "", nil},
+		{"RestrictedExtensions", ".bak/ config .BAK/  .config/", []string{".bak/", ".config/"}},
+		{"RestrictedHeaders", "/Proxy/ if /proxy/", []string{"/proxy/", "/if/"}},
+		{"AllowedMethods", "get POST GET", []string{"GET", "POST"}},
+		{"AllowedRequestContentType", "application/json| Text/Plain |application/json", []string{"application/json", "text/plain"}},
+		//values that do not fit the format are kept as they are
+		{"AllowedHTTPVersions", "HTTP/1.1 http/x", []string{"HTTP/1.1", "http/x"}},
+	}
+
+	for _, tt := range tests {
+		if got := splitList(tt.field, tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitList(%q, %q) = %q, want %q", tt.field, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestApplyListEdits(t *testing.T) {
+	current := owaspSettings{
+		AllowedMethods:       "GET POST",
+		RestrictedExtensions: ".bak/ .config/",
+		RestrictedHeaders:    "/proxy/",
+	}
+	tests := []struct {
+		name       string
+		edits      []owaspListEdit
+		want       owaspSettings
+		wantFields []string
+	}{
+		{
+			name:  "no edits",
+			edits: nil,
+			want:  current,
+		},
+		{
+			name: "add and remove",
+			edits: []owaspListEdit{
+				{Field: "RestrictedExtensions", Values: []string{".sql/"}},
+				{Field: "RestrictedExtensions", Values: []string{".bak/"}, Remove: true},
+			},
+			want: owaspSettings{
+				AllowedMethods:       "GET POST",
+				RestrictedExtensions: ".config/ .sql/",
+				RestrictedHeaders:    "/proxy/",
+			},
+			wantFields: []string{"RestrictedExtensions"},
+		},
+		{
+			name: "values already present or missing",
+			edits: []owaspListEdit{
+				{Field: "AllowedMethods", Values: []string{"GET"}},
+				{Field: "RestrictedHeaders", Values: []string{"/if/"}, Remove: true},
+			},
+			want:       current,
+			wantFields: []string{"AllowedMethods", "RestrictedHeaders"},
+		},
+		{
+			name: "remove every value",
+			edits: []owaspListEdit{
+				{Field: "RestrictedHeaders", Values: []string{"/proxy/"}, Remove: true},
+			},
+			want: owaspSettings{
+				AllowedMethods:       "GET POST",
+				RestrictedExtensions: ".bak/ .config/",
+			},
+			wantFields: []string{"RestrictedHeaders"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, fields := applyListEdits(current, tt.edits)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: applyListEdits() settings = %+v, want %+v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(fields, tt.wantFields) {
+			t.Errorf("%s: applyListEdits() fields = %q, want %q", tt.name, fields, tt.wantFields)
+		}
+	}
+}
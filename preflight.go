@@ -0,0 +1,108 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// operation is an operation asked for on the command line and whether it changes the service
+type operation struct {
+	Flag      string
+	Write     bool
+	Requested bool
+}
+
+// writeRoles are the user roles allowed to change the configuration of a service
+var writeRoles = map[string]bool{
+	"engineer":  true,
+	"superuser": true,
+}
+
+// hasScope tells whether a token carries a scope, tokens can hold several separated by spaces
+func hasScope(token *fastly.Token, scope fastly.TokenScope) bool {
+	for _, s := range strings.Fields(string(token.Scope)) {
+		if fastly.TokenScope(s) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// preflight checks the scope and service restriction of the token and the role of the user
+// against the requested operations, so a run does not stop halfway on a 403
+func preflight(client *fastly.Client, ops []operation, services []string) bool {
+	var reads, writes []string
+	for _, op := range ops {
+		switch {
+		case !op.Requested:
+		case op.Write:
+			writes = append(writes, op.Flag)
+		default:
+			reads = append(reads, op.Flag)
+		}
+	}
+	if len(reads) == 0 && len(writes) == 0 {
+		return true
+	}
+
+	token, ok := reportToken(client)
+	if !ok {
+		return false
+	}
+
+	var problems []string
+	global := hasScope(token, fastly.GlobalScope)
+	if len(writes) > 0 && !global {
+		problems = append(problems, fmt.Sprintf("%s change the service and need a token with %s scope, the token has %q",
+			strings.Join(writes, ", "), fastly.GlobalScope, token.Scope))
+	}
+	if len(reads) > 0 && !global && !hasScope(token, fastly.GlobalReadScope) {
+		problems = append(problems, fmt.Sprintf("%s need a token with %s or %s scope, the token has %q",
+			strings.Join(reads, ", "), fastly.GlobalScope, fastly.GlobalReadScope, token.Scope))
+	}
+
+	if len(token.Services) > 0 {
+		allowed := make(map[string]bool)
+		for _, s := range token.Services {
+			allowed[s] = true
+		}
+		for _, s := range services {
+			if !allowed[s] {
+				problems = append(problems, fmt.Sprintf("the token is limited to services %s and cannot access service %s",
+					strings.Join(token.Services, ", "), s))
+			}
+		}
+	}
+
+	if len(writes) > 0 {
+		user, err := client.GetCurrentUser()
+		switch {
+		case err != nil:
+			Warning.Printf("Cannot read the user role, skipping the role check: GetCurrentUser: %v\n", err)
+		case !writeRoles[user.Role]:
+			problems = append(problems, fmt.Sprintf("%s change the service and need the engineer or superuser role, user %s has the %s role",
+				strings.Join(writes, ", "), user.Login, user.Role))
+		case user.LimitServices:
+			Warning.Printf("User %s is limited to some services, changes to other services will be refused\n", user.Login)
+		}
+	}
+
+	if len(problems) > 0 {
+		Error.Println("Preflight failed, nothing was changed:")
+		for _, p := range problems {
+			Error.Printf("- %s\n", p)
+		}
+		return false
+	}
+
+	Info.Println("Preflight passed: the token and user may run the requested operations")
+	return true
+}
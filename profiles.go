@@ -0,0 +1,110 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// defaultAPIEndpoint is used when neither --apiendpoint nor the profile sets one
+const defaultAPIEndpoint = "https://api.fastly.com"
+
+// serviceIDPattern matches Fastly service IDs, anything else is looked up as an alias or service name
+var serviceIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+
+// Profile is a named Fastly account of the profiles file
+type Profile struct {
+	Name          string `toml:"-"`
+	APIEndpoint   string
+	APIKey        string
+	APIKeyEnv     string
+	APIKeyHelper  string
+	APIKeyFile    string
+	APIKeyKeyring bool
+	Services      map[string]string
+}
+
+// Profiles holds every profile of the profiles file
+type Profiles struct {
+	Default  string
+	Profiles map[string]Profile `toml:"profile"`
+}
+
+// loadProfile reads a named profile, or the default one when no name is given. A missing profiles
+// file is only an error when a profile was asked for.
+func loadProfile(ppath, name string) (Profile, bool) {
+	var profiles Profiles
+	if _, err := os.Stat(ppath); os.IsNotExist(err) {
+		if name != "" {
+			Error.Printf("Profile %q requested but profiles file %s does not exist\n", name, ppath)
+			return Profile{}, false
+		}
+		return Profile{}, true
+	}
+
+	if _, err := toml.DecodeFile(ppath, &profiles); err != nil {
+		Error.Printf("Cannot read profiles file %s: %v\n", ppath, err)
+		return Profile{}, false
+	}
+
+	if name == "" {
+		name = profiles.Default
+	}
+	if name == "" {
+		return Profile{}, true
+	}
+
+	profile, ok := profiles.Profiles[name]
+	if !ok {
+		var names []string
+		for n := range profiles.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		Error.Printf("Profile %q not found in %s, available profiles: %s\n", name, ppath, strings.Join(names, ", "))
+		return Profile{}, false
+	}
+
+	Info.Printf("Using profile %q\n", name)
+	profile.Name = name
+	return profile, true
+}
+
+// resolveAlias replaces a service alias of the profile by what it stands for
+func resolveAlias(profile Profile, name string) string {
+	if id, ok := profile.Services[name]; ok {
+		Info.Printf("Service alias %q stands for %s\n", name, id)
+		return id
+	}
+	return name
+}
+
+// resolveService turns a service alias or name into a service ID. Names are looked up with the
+// service search API, values that look like a service ID are used as they are.
+func resolveService(client *fastly.Client, profile Profile, name string) string {
+	name = resolveAlias(profile, strings.TrimSpace(name))
+	if name == "" || serviceIDPattern.MatchString(name) {
+		return name
+	}
+
+	service, err := client.SearchService(&fastly.SearchServiceInput{
+		Name: name,
+	})
+	if err != nil || service == nil {
+		Warning.Printf("No service named %q found, using it as a service ID\n", name)
+		return name
+	}
+
+	Info.Printf("Service %q resolved to %s\n", name, service.ID)
+	return service.ID
+}
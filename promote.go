@@ -0,0 +1,308 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// PromotionPlan tracks rules moving from log to block mode on a service
+type PromotionPlan struct {
+	ServiceID string
+	Stage     string
+	SoakDays  int `toml:",omitzero"` //soak period of plans written before it was kept per rule
+	Updated   time.Time
+	Rules     []PromotionRule
+}
+
+// PromotionRule is a rule tracked by a promotion plan
+type PromotionRule struct {
+	RuleID     int64
+	Stage      string
+	SoakDays   int
+	LoggedAt   time.Time
+	PromotedAt time.Time
+}
+
+// wafLogEntry is the subset of a WAF log line needed to count rule hits
+type wafLogEntry struct {
+	RuleID string `json:"rule_id"`
+}
+
+// loadPromotionPlan reads a promotion plan from disk, an empty plan is returned if none exists yet
+func loadPromotionPlan(ppath, serviceID string) (PromotionPlan, bool) {
+	plan := PromotionPlan{ServiceID: serviceID, Stage: "log"}
+
+	if _, err := os.Stat(ppath); os.IsNotExist(err) {
+		return plan, true
+	}
+
+	if _, err := toml.DecodeFile(ppath, &plan); err != nil {
+		Error.Printf("Could not read promotion plan %s: %v\n", ppath, err)
+		return plan, false
+	}
+
+	if plan.ServiceID != serviceID {
+		Error.Printf("Promotion plan %s belongs to Service ID %s not %s\n", ppath, plan.ServiceID, serviceID)
+		return plan, false
+	}
+
+	//older plans kept a single soak period for all of their rules
+	if plan.SoakDays != 0 {
+		for i := range plan.Rules {
+			if plan.Rules[i].SoakDays == 0 {
+				plan.Rules[i].SoakDays = plan.SoakDays
+			}
+		}
+		plan.SoakDays = 0
+	}
+
+	return plan, true
+}
+
+// savePromotionPlan stores a promotion plan locally
+func savePromotionPlan(ppath string, plan PromotionPlan) bool {
+
+	//validate the output path
+	d := filepath.Dir(ppath)
+	if _, err := os.Stat(d); os.IsNotExist(err) {
+		Error.Printf("Output path does not exist: %s\n", d)
+		return false
+	}
+
+	//the plan is done once every rule made it to block
+	plan.Stage = "block"
+	for _, r := range plan.Rules {
+		if r.Stage != "block" {
+			plan.Stage = "log"
+			break
+		}
+	}
+	plan.Updated = time.Now()
+
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(plan); err != nil {
+		Error.Println(err)
+		return false
+	}
+
+	if err := ioutil.WriteFile(ppath, buf.Bytes(), 0644); err != nil {
+		Error.Println(err)
+		return false
+	}
+
+	Info.Printf("Promotion plan written to %s\n", ppath)
+	return true
+}
+
+// addToPromotionPlan puts the configured rules in log mode and starts their soak period
+func addToPromotionPlan(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.Client, config TOMLConfig, ppath string, soakDays int) bool {
+
+	if len(config.Rules) == 0 {
+		Error.Println("No rules to add to the promotion plan, set them with --rules or in the config file")
+		return false
+	}
+
+	plan, ok := loadPromotionPlan(ppath, serviceID)
+	if !ok {
+		return false
+	}
+
+	//a rule that was already promoted starts over
+	var pending []int64
+	for _, rule := range config.Rules {
+		tracked := false
+		for _, r := range plan.Rules {
+			if r.RuleID == rule {
+				tracked = true
+				if r.Stage == "block" {
+					pending = append(pending, rule)
+				}
+			}
+		}
+		if !tracked {
+			pending = append(pending, rule)
+		}
+	}
+
+	if len(pending) == 0 {
+		Warning.Println("All rules are already soaking in log mode, nothing to add")
+		return true
+	}
+
+	//move the rules to log through the usual rule status path
+	config.Rules = pending
+	config.Action = "log"
+	added := rulesConfig(apiEndpoint, apiKey, serviceID, wafID, config)
+	if len(added) == 0 {
+		Error.Println("No rule could be put in log mode, the promotion plan was not changed")
+		return false
+	}
+
+	if PatchRules(serviceID, wafID, client, apiKey) {
+		Info.Println("Rule set successfully patched")
+	} else {
+		Error.Println("Issue patching ruleset see above error..")
+		return false
+	}
+
+	//only the rules that made it to log start soaking
+	for _, rule := range added {
+		entry := PromotionRule{RuleID: rule, Stage: "log", SoakDays: soakDays, LoggedAt: time.Now()}
+		tracked := false
+		for i, r := range plan.Rules {
+			if r.RuleID == rule {
+				plan.Rules[i] = entry
+				tracked = true
+			}
+		}
+		if !tracked {
+			plan.Rules = append(plan.Rules, entry)
+		}
+	}
+
+	Info.Printf("%d rule(s) added to the promotion plan with a %d day soak period\n", len(added), soakDays)
+	ok = savePromotionPlan(ppath, plan)
+	return ok && len(added) == len(pending)
+}
+
+// countRuleHits counts how often each rule ID shows up in the given WAF log files
+func countRuleHits(logPaths []string) (map[int64]int, bool) {
+	hits := make(map[int64]int)
+
+	for _, lp := range logPaths {
+		if lp == "" {
+			continue
+		}
+
+		file, err := os.Open(lp)
+		if err != nil {
+			Error.Printf("Could not open WAF log %s: %v\n", lp, err)
+			return hits, false
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			//skip any syslog header in front of the JSON payload
+			i := strings.Index(line, "{")
+			if i < 0 {
+				continue
+			}
+
+			entry := wafLogEntry{}
+			if err := json.Unmarshal([]byte(line[i:]), &entry); err != nil {
+				continue
+			}
+
+			ruleID, err := strconv.ParseInt(entry.RuleID, 10, 64)
+			if err != nil {
+				continue
+			}
+			hits[ruleID]++
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			Error.Printf("Could not read WAF log %s: %v\n", lp, err)
+			return hits, false
+		}
+	}
+
+	return hits, true
+}
+
+// promoteRules moves rules that completed their soak period from log to block
+func promoteRules(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.Client, config TOMLConfig, ppath string, logPaths []string, threshold int) bool {
+
+	if _, err := os.Stat(ppath); os.IsNotExist(err) {
+		Error.Printf("No promotion plan found at %s, create one with --plan-promotion\n", ppath)
+		return false
+	}
+
+	plan, ok := loadPromotionPlan(ppath, serviceID)
+	if !ok {
+		return false
+	}
+
+	hits, ok := countRuleHits(logPaths)
+	if !ok {
+		return false
+	}
+
+	var eligible []int64
+	for _, r := range plan.Rules {
+		if r.Stage != "log" {
+			continue
+		}
+
+		soak := time.Duration(r.SoakDays) * 24 * time.Hour
+		if time.Since(r.LoggedAt) < soak {
+			Info.Printf("- Rule ID: %d\tHeld back: soaking until %s\n", r.RuleID, r.LoggedAt.Add(soak).Format("2006-01-02 15:04"))
+			continue
+		}
+
+		if hits[r.RuleID] > threshold {
+			Warning.Printf("- Rule ID: %d\tHeld back: %d hit(s) in WAF logs, threshold is %d\n", r.RuleID, hits[r.RuleID], threshold)
+			continue
+		}
+
+		Info.Printf("- Rule ID: %d\tEligible: %d hit(s) in WAF logs\n", r.RuleID, hits[r.RuleID])
+		eligible = append(eligible, r.RuleID)
+	}
+
+	if len(eligible) == 0 {
+		Info.Println("No rules are eligible for promotion")
+		return true
+	}
+
+	//move the rules to block through the usual rule status path
+	config.Rules = eligible
+	config.Action = "block"
+	promoted := rulesConfig(apiEndpoint, apiKey, serviceID, wafID, config)
+	if len(promoted) == 0 {
+		Error.Println("No rule could be put in block mode, the promotion plan was not changed")
+		return false
+	}
+
+	if PatchRules(serviceID, wafID, client, apiKey) {
+		Info.Println("Rule set successfully patched")
+	} else {
+		Error.Println("Issue patching ruleset see above error..")
+		return false
+	}
+
+	//rules that failed to update stay in log and are retried on the next run
+	for i, r := range plan.Rules {
+		for _, p := range promoted {
+			if r.RuleID == p {
+				plan.Rules[i].Stage = "block"
+				plan.Rules[i].PromotedAt = time.Now()
+			}
+		}
+	}
+
+	Info.Printf("%d rule(s) promoted to block\n", len(promoted))
+	if len(promoted) < len(eligible) {
+		Warning.Printf("%d eligible rule(s) could not be promoted, see above error..\n", len(eligible)-len(promoted))
+	}
+	ok = savePromotionPlan(ppath, plan)
+	return ok && len(promoted) == len(eligible)
+}
@@ -0,0 +1,61 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCountRuleHits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waflyctl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logs := map[string]string{
+		"waf.log": `{"type":"waf","rule_id":"931100","severity":"2"}
+<134>2019-01-01T00:00:00Z cache-ams21 waflogs[1]: {"type":"waf","rule_id":"931100"}
+{"type":"waf","rule_id":"942100"}
+not a log line
+{"type":"waf","rule_id":
+{"type":"waf","rule_id":""}
+{"type":"req","service_id":"svc1"}
+`,
+		"other.log": `{"type":"waf","rule_id":"942100"}
+`,
+	}
+	for name, content := range logs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  map[int64]int
+		ok    bool
+	}{
+		{"no logs", nil, map[int64]int{}, true},
+		{"empty path", []string{""}, map[int64]int{}, true},
+		{"one log", []string{filepath.Join(dir, "waf.log")}, map[int64]int{931100: 2, 942100: 1}, true},
+		{"several logs", []string{filepath.Join(dir, "waf.log"), filepath.Join(dir, "other.log")}, map[int64]int{931100: 2, 942100: 2}, true},
+		{"missing log", []string{filepath.Join(dir, "missing.log")}, map[int64]int{}, false},
+	}
+
+	for _, tt := range tests {
+		hits, ok := countRuleHits(tt.paths)
+		if ok != tt.ok || !reflect.DeepEqual(hits, tt.want) {
+			t.Errorf("%s: countRuleHits() = %v, %v, want %v, %v", tt.name, hits, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// reportRule is a rule of the WAF with its status and details
+type reportRule struct {
+	ID        string
+	Status    string
+	Publisher string
+	Paranoia  int
+	Message   string
+}
+
+// reportCount is a row of a rule breakdown
+type reportCount struct {
+	Name     string
+	Block    int
+	Log      int
+	Disabled int
+}
+
+// reportSetting is a named value shown in the report
+type reportSetting struct {
+	Name  string
+	Value string
+}
+
+// reportLog is a WAF related logging endpoint and the condition it logs on
+type reportLog struct {
+	Name      string
+	Address   string
+	Port      uint
+	Placement string
+	Condition string
+	Statement string
+}
+
+// postureReport holds everything shown in a WAF posture report
+type postureReport struct {
+	ServiceID        string
+	WAFID            string
+	Version          int
+	Generated        string
+	Status           string
+	ConfigurationSet string
+	LastPush         string
+	Owasp            []reportSetting
+	Total            reportCount
+	ByPublisher      []reportCount
+	ByParanoia       []reportCount
+	Logs             []reportLog
+	Disabled         []reportRule
+}
+
+// add counts a rule in the row
+func (c *reportCount) add(status string) {
+	switch status {
+	case "block":
+		c.Block++
+	case "log":
+		c.Log++
+	case "disabled":
+		c.Disabled++
+	}
+}
+
+// countRule adds a rule to a breakdown row
+func countRule(rows map[string]*reportCount, name, status string) {
+	row, ok := rows[name]
+	if !ok {
+		row = &reportCount{Name: name}
+		rows[name] = row
+	}
+	row.add(status)
+}
+
+// sortedCounts returns the rows of a breakdown ordered by name
+func sortedCounts(rows map[string]*reportCount) []reportCount {
+	var counts []reportCount
+	for _, row := range rows {
+		counts = append(counts, *row)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Name < counts[j].Name })
+	return counts
+}
+
+// collectReport gathers the posture of a WAF
+func collectReport(client *fastly.Client, apiEndpoint, apiKey, serviceID string, waf *fastly.WAF, version int) (postureReport, bool) {
+	report := postureReport{
+		ServiceID: serviceID,
+		WAFID:     waf.ID,
+		Version:   version,
+		Generated: time.Now().UTC().Format(time.RFC1123),
+		Status:    "unknown",
+		LastPush:  "never",
+		Total:     reportCount{Name: "All rules"},
+	}
+	if waf.ConfigurationSet != nil {
+		report.ConfigurationSet = waf.ConfigurationSet.ID
+	}
+	if waf.LastPush != nil {
+		report.LastPush = waf.LastPush.UTC().Format(time.RFC1123)
+	}
+
+	if disabled, ok := getWAFDisabled(apiEndpoint, apiKey, serviceID, waf.ID, version); ok {
+		report.Status = "enabled"
+		if disabled {
+			report.Status = "disabled"
+		}
+	}
+
+	//rule statuses and OWASP settings as gathered for a backup
+	backup, ok := collectBackup(apiEndpoint, apiKey, serviceID, waf.ID, client)
+	if !ok {
+		return report, false
+	}
+
+	o := reflect.ValueOf(backup.Owasp)
+	for i := 0; i < o.NumField(); i++ {
+		report.Owasp = append(report.Owasp, reportSetting{Name: o.Type().Field(i).Name, Value: fmt.Sprint(o.Field(i).Interface())})
+	}
+
+	//rule details as listed by getRules
+	byPublisher := make(map[string]*reportCount)
+	byParanoia := make(map[string]*reportCount)
+	statuses := map[string][]int64{"block": backup.Block, "log": backup.Log, "disabled": backup.Disabled}
+	Info.Printf("Reading details of %d rules\n", len(backup.Block)+len(backup.Log)+len(backup.Disabled))
+	for _, status := range []string{"block", "log", "disabled"} {
+		for _, id := range statuses[status] {
+			ruleID := strconv.FormatInt(id, 10)
+			info := getRuleInfo(apiEndpoint, apiKey, ruleID)
+			rule := reportRule{
+				ID:        ruleID,
+				Status:    status,
+				Publisher: info.Attributes.Publisher,
+				Paranoia:  info.Attributes.ParanoiaLevel,
+				Message:   info.Attributes.Message,
+			}
+
+			report.Total.add(status)
+			countRule(byPublisher, rule.Publisher, status)
+			countRule(byParanoia, strconv.Itoa(rule.Paranoia), status)
+			if status == "disabled" {
+				report.Disabled = append(report.Disabled, rule)
+			}
+		}
+	}
+	report.ByPublisher = sortedCounts(byPublisher)
+	report.ByParanoia = sortedCounts(byParanoia)
+
+	//logging endpoints and their conditions
+	syslogs, err := client.ListSyslogs(&fastly.ListSyslogsInput{
+		Service: serviceID,
+		Version: version,
+	})
+	if err != nil {
+		Error.Printf("Cannot list logging endpoints: ListSyslogs: %v\n", err)
+		return report, false
+	}
+	for _, s := range syslogs {
+		if s.Placement != "waf_debug" && !strings.HasPrefix(s.ResponseCondition, "waf-soc-logging") {
+			continue
+		}
+		l := reportLog{
+			Name:      s.Name,
+			Address:   s.Address,
+			Port:      s.Port,
+			Placement: s.Placement,
+			Condition: s.ResponseCondition,
+		}
+		if s.ResponseCondition != "" {
+			cond, err := client.GetCondition(&fastly.GetConditionInput{
+				Service: serviceID,
+				Version: version,
+				Name:    s.ResponseCondition,
+			})
+			if err != nil {
+				Warning.Printf("Cannot read logging condition %q: GetCondition: %v\n", s.ResponseCondition, err)
+			} else {
+				l.Statement = cond.Statement
+			}
+		}
+		report.Logs = append(report.Logs, l)
+	}
+
+	return report, true
+}
+
+// markdownReport lays out the posture report as Markdown
+const markdownReport = `# WAF posture report
+
+| | |
+|---|---|
+| Service | {{.ServiceID}} |
+| WAF | {{.WAFID}} |
+| Version | {{.Version}} |
+| Status | {{.Status}} |
+| Configuration set | {{.ConfigurationSet}} |
+| Ruleset last push | {{.LastPush}} |
+| Generated | {{.Generated}} |
+
+## Rules
+
+| | Block | Log | Disabled |
+|---|---|---|---|
+| {{.Total.Name}} | {{.Total.Block}} | {{.Total.Log}} | {{.Total.Disabled}} |
+
+### By publisher
+
+| Publisher | Block | Log | Disabled |
+|---|---|---|---|
+{{range .ByPublisher}}| {{.Name}} | {{.Block}} | {{.Log}} | {{.Disabled}} |
+{{end}}
+### By paranoia level
+
+| Paranoia level | Block | Log | Disabled |
+|---|---|---|---|
+{{range .ByParanoia}}| {{.Name}} | {{.Block}} | {{.Log}} | {{.Disabled}} |
+{{end}}
+## OWASP settings
+
+| Setting | Value |
+|---|---|
+{{range .Owasp}}| {{.Name}} | {{md .Value}} |
+{{end}}
+## Logging endpoints
+
+| Name | Address | Placement | Condition | Statement |
+|---|---|---|---|---|
+{{range .Logs}}| {{.Name}} | {{.Address}}:{{.Port}} | {{.Placement}} | {{.Condition}} | {{md .Statement}} |
+{{end}}
+## Disabled rules
+
+| Rule ID | Publisher | Paranoia level | Message |
+|---|---|---|---|
+{{range .Disabled}}| {{.ID}} | {{.Publisher}} | {{.Paranoia}} | {{md .Message}} |
+{{end}}`
+
+// htmlReport lays out the posture report as a self-contained HTML page
+const htmlReport = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>WAF posture report {{.ServiceID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+.disabled { color: #b00; font-weight: bold; }
+.enabled { color: #070; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>WAF posture report</h1>
+<table>
+<tr><th>Service</th><td>{{.ServiceID}}</td></tr>
+<tr><th>WAF</th><td>{{.WAFID}}</td></tr>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+<tr><th>Status</th><td class="{{.Status}}">{{.Status}}</td></tr>
+<tr><th>Configuration set</th><td>{{.ConfigurationSet}}</td></tr>
+<tr><th>Ruleset last push</th><td>{{.LastPush}}</td></tr>
+<tr><th>Generated</th><td>{{.Generated}}</td></tr>
+</table>
+
+<h2>Rules</h2>
+<table>
+<tr><th></th><th>Block</th><th>Log</th><th>Disabled</th></tr>
+<tr><td>{{.Total.Name}}</td><td>{{.Total.Block}}</td><td>{{.Total.Log}}</td><td>{{.Total.Disabled}}</td></tr>
+</table>
+
+<h3>By publisher</h3>
+<table>
+<tr><th>Publisher</th><th>Block</th><th>Log</th><th>Disabled</th></tr>
+{{range .ByPublisher}}<tr><td>{{.Name}}</td><td>{{.Block}}</td><td>{{.Log}}</td><td>{{.Disabled}}</td></tr>
+{{end}}</table>
+
+<h3>By paranoia level</h3>
+<table>
+<tr><th>Paranoia level</th><th>Block</th><th>Log</th><th>Disabled</th></tr>
+{{range .ByParanoia}}<tr><td>{{.Name}}</td><td>{{.Block}}</td><td>{{.Log}}</td><td>{{.Disabled}}</td></tr>
+{{end}}</table>
+
+<h2>OWASP settings</h2>
+<table>
+<tr><th>Setting</th><th>Value</th></tr>
+{{range .Owasp}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+
+<h2>Logging endpoints</h2>
+<table>
+<tr><th>Name</th><th>Address</th><th>Placement</th><th>Condition</th><th>Statement</th></tr>
+{{range .Logs}}<tr><td>{{.Name}}</td><td>{{.Address}}:{{.Port}}</td><td>{{.Placement}}</td><td>{{.Condition}}</td><td><code>{{.Statement}}</code></td></tr>
+{{end}}</table>
+
+<h2>Disabled rules</h2>
+<table>
+<tr><th>Rule ID</th><th>Publisher</th><th>Paranoia level</th><th>Message</th></tr>
+{{range .Disabled}}<tr><td>{{.ID}}</td><td>{{.Publisher}}</td><td>{{.Paranoia}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`
+
+// writeReport renders the posture report of a WAF as HTML or Markdown
+func writeReport(client *fastly.Client, apiEndpoint, apiKey, serviceID string, waf *fastly.WAF, version int, rpath, format string) bool {
+
+	//validate the output path
+	d := filepath.Dir(rpath)
+	if _, err := os.Stat(d); os.IsNotExist(err) {
+		Error.Printf("Output path does not exist: %s\n", d)
+		return false
+	}
+
+	report, ok := collectReport(client, apiEndpoint, apiKey, serviceID, waf, version)
+	if !ok {
+		return false
+	}
+
+	buf := new(bytes.Buffer)
+	var err error
+	switch format {
+	case "markdown":
+		md := func(s string) string {
+			return strings.Replace(strings.Replace(s, "|", "\\|", -1), "\n", " ", -1)
+		}
+		t := texttemplate.Must(texttemplate.New("report").Funcs(texttemplate.FuncMap{"md": md}).Parse(markdownReport))
+		err = t.Execute(buf, report)
+	default:
+		t := htmltemplate.Must(htmltemplate.New("report").Parse(htmlReport))
+		err = t.Execute(buf, report)
+	}
+	if err != nil {
+		Error.Println(err)
+		return false
+	}
+
+	err = ioutil.WriteFile(rpath, buf.Bytes(), 0644)
+	if err != nil {
+		Error.Println(err)
+		return false
+	}
+
+	Info.Printf("Bytes written: %d to %s\n", buf.Len(), rpath)
+	return true
+}
@@ -0,0 +1,307 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// hclString quotes a value for HCL, escaping template sequences such as the %{...}V of log formats
+func hclString(s string) string {
+	q := strconv.Quote(s)
+	q = strings.Replace(q, "${", "$${", -1)
+	return strings.Replace(q, "%{", "%%{", -1)
+}
+
+// hclWriter renders indented HCL blocks and attributes
+type hclWriter struct {
+	buf    bytes.Buffer
+	indent int
+}
+
+func (w *hclWriter) line(format string, args ...interface{}) {
+	if format != "" {
+		w.buf.WriteString(strings.Repeat("  ", w.indent))
+	}
+	fmt.Fprintf(&w.buf, format+"\n", args...)
+}
+
+func (w *hclWriter) open(header string) {
+	w.line("%s {", header)
+	w.indent++
+}
+
+func (w *hclWriter) close() {
+	w.indent--
+	w.line("}")
+}
+
+func (w *hclWriter) str(name, value string) {
+	if value != "" {
+		w.line("%s = %s", name, hclString(value))
+	}
+}
+
+func (w *hclWriter) num(name string, value interface{}) {
+	w.line("%s = %v", name, value)
+}
+
+// writeTerraformCondition renders a condition block of the service
+func writeTerraformCondition(w *hclWriter, c *fastly.Condition) {
+	w.open("condition")
+	w.str("name", c.Name)
+	w.str("statement", c.Statement)
+	w.str("type", c.Type)
+	w.num("priority", c.Priority)
+	w.close()
+}
+
+// writeTerraformOWASP renders the OWASP settings as attributes of the WAF configuration resource
+func writeTerraformOWASP(w *hclWriter, o owaspSettings) {
+	w.str("allowed_http_versions", o.AllowedHTTPVersions)
+	w.str("allowed_methods", o.AllowedMethods)
+	w.str("allowed_request_content_type", o.AllowedRequestContentType)
+	w.str("allowed_request_content_type_charset", o.AllowedRequestContentTypeCharset)
+	w.num("arg_length", o.ArgLength)
+	w.num("arg_name_length", o.ArgNameLength)
+	w.num("combined_file_sizes", o.CombinedFileSizes)
+	w.num("critical_anomaly_score", o.CriticalAnomalyScore)
+	w.num("crs_validate_utf8_encoding", o.CRSValidateUTF8Encoding)
+	w.num("error_anomaly_score", o.ErrorAnomalyScore)
+	w.num("http_violation_score_threshold", o.HTTPViolationScoreThreshold)
+	w.num("inbound_anomaly_score_threshold", o.InboundAnomalyScoreThreshold)
+	w.num("lfi_score_threshold", o.LFIScoreThreshold)
+	w.num("max_file_size", o.MaxFileSize)
+	w.num("max_num_args", o.MaxNumArgs)
+	w.num("notice_anomaly_score", o.NoticeAnomalyScore)
+	w.num("paranoia_level", o.ParanoiaLevel)
+	w.num("php_injection_score_threshold", o.PHPInjectionScoreThreshold)
+	w.num("rce_score_threshold", o.RCEScoreThreshold)
+	w.str("restricted_extensions", o.RestrictedExtensions)
+	w.str("restricted_headers", o.RestrictedHeaders)
+	w.num("rfi_score_threshold", o.RFIScoreThreshold)
+	w.num("session_fixation_score_threshold", o.SessionFixationScoreThreshold)
+	w.num("sql_injection_score_threshold", o.SQLInjectionScoreThreshold)
+	w.num("total_arg_length", o.TotalArgLength)
+	w.num("warning_anomaly_score", o.WarningAnomalyScore)
+	w.num("xss_score_threshold", o.XSSScoreThreshold)
+}
+
+// exportTerraform writes the WAF setup of a service as Terraform HCL together with the matching import IDs
+func exportTerraform(client *fastly.Client, apiEndpoint, apiKey, serviceID string, waf *fastly.WAF, version int, tpath string) bool {
+
+	//validate the output path
+	d := filepath.Dir(tpath)
+	if _, err := os.Stat(d); os.IsNotExist(err) {
+		Error.Printf("Output path does not exist: %s\n", d)
+		return false
+	}
+
+	//rule statuses and OWASP settings as gathered for a backup
+	backup, ok := collectBackup(apiEndpoint, apiKey, serviceID, waf.ID, client)
+	if !ok {
+		return false
+	}
+
+	//versioned objects of the WAF
+	var conditions []*fastly.Condition
+	getCondition := func(name string) bool {
+		for _, c := range conditions {
+			if c.Name == name {
+				return true
+			}
+		}
+		c, err := client.GetCondition(&fastly.GetConditionInput{
+			Service: serviceID,
+			Version: version,
+			Name:    name,
+		})
+		if err != nil {
+			Error.Printf("Cannot read condition %q: GetCondition: %v\n", name, err)
+			return false
+		}
+		conditions = append(conditions, c)
+		return true
+	}
+
+	if waf.PrefetchCondition != "" && !getCondition(waf.PrefetchCondition) {
+		return false
+	}
+
+	var response *fastly.ResponseObject
+	if waf.Response != "" {
+		var err error
+		response, err = client.GetResponseObject(&fastly.GetResponseObjectInput{
+			Service: serviceID,
+			Version: version,
+			Name:    waf.Response,
+		})
+		if err != nil {
+			Error.Printf("Cannot read response object %q: GetResponseObject: %v\n", waf.Response, err)
+			return false
+		}
+	}
+
+	snippets := TOMLConfig{}
+	if !exportSnippets(client, serviceID, version, &snippets) {
+		return false
+	}
+	var snippetList []VCLSnippetSettings
+	if snippets.Vclsnippet.Name != "" {
+		snippetList = append(snippetList, snippets.Vclsnippet)
+	}
+	names := make([]string, 0, len(snippets.AdditionalSnippets))
+	for name := range snippets.AdditionalSnippets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		snippetList = append(snippetList, snippets.AdditionalSnippets[name])
+	}
+
+	allSyslogs, err := client.ListSyslogs(&fastly.ListSyslogsInput{
+		Service: serviceID,
+		Version: version,
+	})
+	if err != nil {
+		Error.Printf("Cannot list logging endpoints: ListSyslogs: %v\n", err)
+		return false
+	}
+	var syslogs []*fastly.Syslog
+	for _, s := range allSyslogs {
+		if s.Placement == "waf_debug" || strings.HasPrefix(s.ResponseCondition, "waf-soc-logging") {
+			syslogs = append(syslogs, s)
+			if s.ResponseCondition != "" && !getCondition(s.ResponseCondition) {
+				return false
+			}
+		}
+	}
+
+	serviceName := "service_" + strings.ToLower(serviceID)
+	wafName := "waf_" + strings.ToLower(waf.ID)
+	imports := []string{
+		fmt.Sprintf("terraform import fastly_service_v1.%s %s", serviceName, serviceID),
+		fmt.Sprintf("terraform import fastly_service_waf_configuration.%s %s", wafName, waf.ID),
+	}
+
+	w := &hclWriter{}
+	w.line("# Exported by waflyctl from WAF %s on service %s version %d", waf.ID, serviceID, version)
+	w.line("#")
+	w.line("# The service blocks below only cover the WAF setup, merge them into the resource")
+	w.line("# managing the rest of the service. Import the existing objects with:")
+	for _, i := range imports {
+		w.line("#   %s", i)
+	}
+	w.line("")
+
+	w.open(fmt.Sprintf("resource \"fastly_service_v1\" %q", serviceName))
+	for _, c := range conditions {
+		writeTerraformCondition(w, c)
+		w.line("")
+	}
+	if response != nil {
+		w.open("response_object")
+		w.str("name", response.Name)
+		w.num("status", response.Status)
+		w.str("response", response.Response)
+		w.str("content_type", response.ContentType)
+		w.str("content", response.Content)
+		w.close()
+		w.line("")
+	}
+	for _, s := range snippetList {
+		if s.Dynamic == 1 {
+			w.open("dynamicsnippet")
+		} else {
+			w.open("snippet")
+		}
+		w.str("name", s.Name)
+		w.str("type", string(s.Type))
+		w.num("priority", s.Priority)
+		if s.Dynamic != 1 {
+			w.str("content", s.Content)
+		}
+		w.close()
+		w.line("")
+	}
+	for _, s := range syslogs {
+		w.open("logging_syslog")
+		w.str("name", s.Name)
+		w.str("address", s.Address)
+		w.num("port", s.Port)
+		w.num("use_tls", s.UseTLS)
+		w.str("tls_ca_cert", s.TLSCACert)
+		w.str("tls_hostname", s.TLSHostname)
+		w.str("format", s.Format)
+		w.num("format_version", s.FormatVersion)
+		w.str("message_type", s.MessageType)
+		w.str("response_condition", s.ResponseCondition)
+		w.str("placement", s.Placement)
+		w.close()
+		w.line("")
+	}
+	w.open("waf")
+	w.str("prefetch_condition", waf.PrefetchCondition)
+	w.str("response_object", waf.Response)
+	w.close()
+	w.close()
+	w.line("")
+
+	//rule statuses and OWASP settings live on the WAF configuration resource
+	rules := make(map[int64]string)
+	for _, id := range backup.Log {
+		rules[id] = "log"
+	}
+	for _, id := range backup.Block {
+		rules[id] = "block"
+	}
+	ids := make([]int64, 0, len(rules))
+	for id := range rules {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	w.open(fmt.Sprintf("resource \"fastly_service_waf_configuration\" %q", wafName))
+	w.line("waf_id = fastly_service_v1.%s.waf[0].waf_id", serviceName)
+	writeTerraformOWASP(w, backup.Owasp)
+	if len(backup.Disabled) > 0 {
+		//the provider only accepts the log, block and score statuses
+		w.line("")
+		w.line("# %d disabled rule(s) are left out, the provider only manages rules in log, block or score", len(backup.Disabled))
+		Info.Printf("Leaving %d disabled rule(s) out of the WAF configuration\n", len(backup.Disabled))
+	}
+	for _, id := range ids {
+		w.line("")
+		w.open("rule")
+		w.num("modsec_rule_id", id)
+		w.str("status", rules[id])
+		w.close()
+	}
+	w.close()
+
+	err = ioutil.WriteFile(tpath, w.buf.Bytes(), 0644)
+	if err != nil {
+		Error.Println(err)
+		return false
+	}
+	Info.Printf("Bytes written: %d to %s\n", w.buf.Len(), tpath)
+
+	Info.Println("Import the existing objects into Terraform state with:")
+	for _, i := range imports {
+		fmt.Println(i)
+	}
+	return true
+}
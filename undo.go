@@ -0,0 +1,291 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// lastJournalRun returns the ID of the most recent run that changed the service
+func lastJournalRun(entries []JournalEntry, serviceID string) string {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].ServiceID == serviceID {
+			return entries[i].RunID
+		}
+	}
+	return ""
+}
+
+// journalInt reads a version number stored as a before or after value
+func journalInt(v interface{}) int {
+	switch n := v.(type) {
+	case float64:
+		return int(n)
+	case int:
+		return n
+	case string:
+		i, _ := strconv.Atoi(n)
+		return i
+	}
+	return 0
+}
+
+// journalChange is the oldest before and newest after value of an object changed by a run
+type journalChange struct {
+	Before string
+	After  string
+}
+
+// undoRun reverses the changes journaled for a run on a service
+func undoRun(client *fastly.Client, apiEndpoint, apiKey, serviceID, runID, jpath string, config TOMLConfig, activeVersion int) bool {
+	entries, ok := readJournal(jpath)
+	if !ok {
+		return false
+	}
+
+	if runID == "" {
+		runID = lastJournalRun(entries, serviceID)
+		if runID == "" {
+			Error.Printf("No journaled runs found for Service ID %s in %s\n", serviceID, jpath)
+			return false
+		}
+	}
+
+	var run []JournalEntry
+	for _, e := range entries {
+		if e.RunID == runID && e.ServiceID == serviceID {
+			run = append(run, e)
+		}
+	}
+	if len(run) == 0 {
+		Error.Printf("Run %s has no journaled changes on Service ID %s\n", runID, serviceID)
+		return false
+	}
+	Info.Printf("Undoing run %s by %s from %s (%d change(s))\n", runID, run[0].Operator, run[0].Time.Format("2006-01-02 15:04:05"), len(run))
+
+	//drafts edited in place through --service-version have no earlier copy to go back to
+	var edited []int
+	for _, e := range run {
+		if e.Resource == "version" && e.Action == "edit" {
+			edited = append(edited, e.Version)
+		}
+	}
+	if len(edited) > 0 {
+		for _, v := range edited {
+			Error.Printf("Run %s edited draft version %d in place, its previous contents were not kept\n", runID, v)
+		}
+		Error.Println("Refusing to undo the run, nothing was changed. Review or delete the draft version(s) by hand and revert the remaining changes with the --history entries of the run")
+		return false
+	}
+
+	//walk the run backwards so the oldest before value of every object wins
+	rules := make(map[string]map[string]string)
+	owasp := make(map[string]owaspSettings)
+	wafStatus := make(map[string]journalChange)
+	configSets := make(map[string]journalChange)
+	unknown := make(map[string]map[string]bool)
+	var versions []JournalEntry
+	result := true
+
+	for i := len(run) - 1; i >= 0; i-- {
+		e := run[i]
+		switch e.Resource {
+		case "rule_status":
+			before, ok := e.Before.(string)
+			if !ok || before == "" {
+				if unknown[e.WAFID] == nil {
+					unknown[e.WAFID] = make(map[string]bool)
+				}
+				unknown[e.WAFID][e.Name] = true
+				delete(rules[e.WAFID], e.Name)
+				continue
+			}
+			delete(unknown[e.WAFID], e.Name)
+			if rules[e.WAFID] == nil {
+				rules[e.WAFID] = make(map[string]string)
+			}
+			rules[e.WAFID][e.Name] = before
+
+		case "owasp":
+			if e.Before == nil {
+				Warning.Printf("OWASP object of WAF %s was created by the run, leaving it in place\n", e.WAFID)
+				continue
+			}
+			b, _ := json.Marshal(e.Before)
+			o := owaspSettings{}
+			if err := json.Unmarshal(b, &o); err != nil {
+				Error.Printf("Cannot read journaled OWASP settings of WAF %s: %v\n", e.WAFID, err)
+				result = false
+				continue
+			}
+			owasp[e.WAFID] = o
+
+		case "waf_status":
+			after, _ := e.After.(string)
+			before, _ := e.Before.(string)
+			if before == "" {
+				//entries of older runs only have the status the run set
+				switch after {
+				case "enable":
+					before = "disable"
+				case "disable":
+					before = "enable"
+				}
+			}
+			if current, ok := wafStatus[e.WAFID]; ok {
+				after = current.After
+			}
+			wafStatus[e.WAFID] = journalChange{Before: before, After: after}
+
+		case "version":
+			versions = append(versions, e)
+
+		case "configuration_set":
+			after, _ := e.After.(string)
+			before, _ := e.Before.(string)
+			if before == "" {
+				Warning.Printf("No previous configuration set journaled for WAF %s, skipping\n", e.WAFID)
+				continue
+			}
+			if current, ok := configSets[e.WAFID]; ok {
+				after = current.After
+			}
+			configSets[e.WAFID] = journalChange{Before: before, After: after}
+		}
+	}
+
+	//rules without a journaled previous status cannot be restored
+	for wafID, ids := range unknown {
+		if len(ids) == 0 {
+			continue
+		}
+		var names []string
+		for id := range ids {
+			names = append(names, id)
+		}
+		sort.Strings(names)
+		Error.Printf("No previous status journaled for %d rule(s) on WAF %s, they keep their current status: %s\n", len(names), wafID, strings.Join(names, ", "))
+		result = false
+	}
+
+	//versionless changes first: configuration sets, the rule statuses apply to the restored set
+	for wafID, set := range configSets {
+		if set.Before == set.After {
+			continue
+		}
+		Info.Printf("Restoring configuration set of WAF %s to %s\n", wafID, set.Before)
+		if !setConfigurationSet(wafID, set.After, set.Before, client) {
+			result = false
+		}
+	}
+
+	//rule statuses
+	for wafID, statuses := range rules {
+		changed := make(map[string][]int64)
+		for id, status := range statuses {
+			ruleID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				Error.Printf("Failed to parse rule as int %s\n", id)
+				continue
+			}
+			changed[status] = append(changed[status], ruleID)
+		}
+		for status, ids := range changed {
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			Info.Printf("Restoring %d rule(s) on WAF %s to %s\n", len(ids), wafID, status)
+			c := config
+			c.Rules = ids
+			c.Action = status
+			if updated := rulesConfig(apiEndpoint, apiKey, serviceID, wafID, c); len(updated) < len(ids) {
+				result = false
+			}
+		}
+		if PatchRules(serviceID, wafID, client, apiKey) {
+			Info.Println("Rule set successfully patched")
+		} else {
+			Error.Println("Issue patching ruleset see above error..")
+			result = false
+		}
+	}
+
+	//OWASP settings
+	for wafID, o := range owasp {
+		Info.Printf("Restoring OWASP settings of WAF %s\n", wafID)
+		c := config
+		c.Owasp = o
+		createOWASP(client, serviceID, c, wafID, nil)
+		if _, patched := rules[wafID]; !patched {
+			if !PatchRules(serviceID, wafID, client, apiKey) {
+				Error.Println("Issue patching ruleset see above error..")
+				result = false
+			}
+		}
+	}
+
+	//WAF status
+	for wafID, status := range wafStatus {
+		if status.Before == "" || status.Before == status.After {
+			continue
+		}
+		Info.Printf("Restoring WAF %s status to %s\n", wafID, status.Before)
+		changeStatus(apiEndpoint, apiKey, wafID, status.After, status.Before)
+	}
+
+	//versioned changes go back to the version that was active before the run
+	for _, e := range versions {
+		previous := journalInt(e.Before)
+		created := journalInt(e.After)
+		if previous == 0 || created == 0 {
+			continue
+		}
+
+		switch activeVersion {
+		case created:
+			Info.Printf("Version %d created by the run is active, reactivating version %d\n", created, previous)
+			_, err := client.ActivateVersion(&fastly.ActivateVersionInput{
+				Service: serviceID,
+				Version: previous,
+			})
+			if err != nil {
+				Error.Printf("Cannot activate version %d: ActivateVersion: %v\n", previous, err)
+				result = false
+				continue
+			}
+			recordChange(JournalEntry{
+				ServiceID: serviceID,
+				Version:   previous,
+				Resource:  "version",
+				Name:      strconv.Itoa(previous),
+				Action:    "activate",
+				Before:    created,
+				After:     previous,
+			})
+			activeVersion = previous
+			Info.Printf("Version %d activated\n", previous)
+
+		case previous:
+			Info.Printf("Version %d created by the run was never activated, nothing to undo\n", created)
+
+		default:
+			Warning.Printf("Active version %d is neither version %d nor %d, cloning version %d for review\n", activeVersion, previous, created, previous)
+			version := cloneVersion(client, serviceID, previous, fmt.Sprintf("waflyctl undo of run %s", runID))
+			if validateVersion(client, serviceID, version) {
+				Info.Printf("Version %d restores the configuration from before run %s\n", version, runID)
+			} else {
+				result = false
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,336 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// owaspListFormats are the delimiter formats of the OWASP list settings, every item has to match
+var owaspListFormats = map[string]struct {
+	Separator string
+	Item      *regexp.Regexp
+	Example   string
+}{
+	"AllowedHTTPVersions":              {" ", regexp.MustCompile(`^HTTP/\d(\.\d)?$`), "HTTP/1.1 HTTP/2"},
+	"AllowedMethods":                   {" ", regexp.MustCompile(`^[A-Z]+$`), "GET HEAD POST"},
+	"AllowedRequestContentType":        {"|", regexp.MustCompile(`(?i)^[a-z0-9.+-]+/[a-z0-9.+*-]+$`), "application/json|text/plain"},
+	"AllowedRequestContentTypeCharset": {"|", regexp.MustCompile(`(?i)^[a-z0-9._-]+$`), "utf-8|iso-8859-1"},
+	"RestrictedExtensions":             {" ", regexp.MustCompile(`^\.[A-Za-z0-9_-]+/$`), ".bak/ .config/"},
+	"RestrictedHeaders":                {" ", regexp.MustCompile(`(?i)^/[a-z0-9_-]+/$`), "/proxy/ /if/"},
+}
+
+// snippetTypes are the VCL subroutines a snippet can go in
+var snippetTypes = map[fastly.SnippetType]bool{
+	fastly.SnippetTypeInit:    true,
+	fastly.SnippetTypeRecv:    true,
+	fastly.SnippetTypeHash:    true,
+	fastly.SnippetTypeHit:     true,
+	fastly.SnippetTypeMiss:    true,
+	fastly.SnippetTypePass:    true,
+	fastly.SnippetTypeFetch:   true,
+	fastly.SnippetTypeError:   true,
+	fastly.SnippetTypeDeliver: true,
+	fastly.SnippetTypeLog:     true,
+	fastly.SnippetTypeNone:    true,
+}
+
+// logFormatVariable matches a %{...}V style variable of a log format
+var logFormatVariable = regexp.MustCompile(`%\{[^{}]+\}[A-Za-z]`)
+
+// configProblem is a finding of the config validation
+type configProblem struct {
+	Key     string
+	Source  string
+	Message string
+	Warning bool
+}
+
+// configValidator collects the problems found in the effective config
+type configValidator struct {
+	layered  layeredConfig
+	problems []configProblem
+}
+
+// source finds where a key of the effective config was set, keys are not case sensitive
+func (v *configValidator) source(key string) string {
+	for k, s := range v.layered.Sources {
+		if strings.EqualFold(k, key) {
+			return s
+		}
+	}
+	for k, s := range v.layered.Sources {
+		if strings.HasPrefix(strings.ToLower(k), strings.ToLower(key)+".") {
+			return s
+		}
+	}
+	return ""
+}
+
+// errorf records an error on a key
+func (v *configValidator) errorf(key, format string, args ...interface{}) {
+	v.problems = append(v.problems, configProblem{Key: key, Source: v.source(key), Message: fmt.Sprintf(format, args...)})
+}
+
+// warnf records a warning on a key
+func (v *configValidator) warnf(key, format string, args ...interface{}) {
+	v.problems = append(v.problems, configProblem{Key: key, Source: v.source(key), Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// checkVCLCondition looks for the syntax mistakes that make Fastly refuse a VCL condition
+func (v *configValidator) checkVCLCondition(key, statement string) {
+	s := strings.TrimSpace(statement)
+	if s == "" {
+		v.errorf(key, "the condition is empty")
+		return
+	}
+
+	depth, quoted := 0, false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		}
+		if depth < 0 {
+			break
+		}
+	}
+	if quoted {
+		v.errorf(key, "unterminated string in condition %q", s)
+	}
+	if depth != 0 {
+		v.errorf(key, "unbalanced parentheses in condition %q", s)
+	}
+	if strings.Contains(s, ";") {
+		v.errorf(key, "a condition is an expression and cannot hold %q", ";")
+	}
+	for _, op := range []string{"&&", "||", "!", "==", "!=", "~"} {
+		if strings.HasSuffix(s, op) || (op != "!" && strings.HasPrefix(s, op)) {
+			v.errorf(key, "condition %q starts or ends with operator %s", s, op)
+		}
+	}
+}
+
+// checkLogFormat looks for a quote left unescaped among escaped ones and broken %{...}V variables in a log format
+func (v *configValidator) checkLogFormat(key, format string) {
+	if format == "" {
+		return
+	}
+	if strings.Contains(format, `\"`) {
+		for i, c := range format {
+			if c == '"' && (i == 0 || format[i-1] != '\\') {
+				v.errorf(key, "unescaped quote at position %d of a log format with escaped quotes, write it as \\\"", i)
+				break
+			}
+		}
+	}
+	if strings.Count(format, "%{") != len(logFormatVariable.FindAllString(format, -1)) {
+		v.errorf(key, "the log format has a %%{ without a closing }V")
+	}
+}
+
+// checkLogEndpoint checks the address, port and TLS settings of a logging endpoint
+func (v *configValidator) checkLogEndpoint(table, address string, port uint, tlscacert, format string) {
+	if strings.TrimSpace(address) == "" {
+		v.errorf(table+".Address", "a logging endpoint needs an address")
+	}
+	if port == 0 || port > 65535 {
+		v.errorf(table+".Port", "port %d is not between 1 and 65535", port)
+	}
+	if tlscacert != "" {
+		rest := []byte(tlscacert)
+		certs := 0
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+				v.errorf(table+".Tlscacert", "cannot parse certificate: %v", err)
+			}
+			certs++
+		}
+		if certs == 0 {
+			v.errorf(table+".Tlscacert", "no PEM encoded certificate found")
+		}
+	}
+	v.checkLogFormat(table+".Format", format)
+}
+
+// checkOWASPSettings checks the list syntax and numeric ranges of the OWASP settings set in the
+// config, the others are not sent to Fastly
+func (v *configValidator) checkOWASPSettings(o owaspSettings, fields []string) {
+	ov := reflect.ValueOf(o)
+	set := make(map[string]bool)
+	for _, name := range fields {
+		set[name] = true
+		key := "Owasp." + name
+		switch f := ov.FieldByName(name).Interface().(type) {
+		case string:
+			format, ok := owaspListFormats[name]
+			if !ok || f == "" {
+				continue
+			}
+			for _, item := range strings.Split(f, format.Separator) {
+				if format.Separator == " " && item == "" {
+					continue
+				}
+				if !format.Item.MatchString(item) {
+					v.errorf(key, "%q does not fit the list format, expected something like %q", item, format.Example)
+				}
+			}
+		case int:
+			switch {
+			case name == "ParanoiaLevel" && (f < 1 || f > 4):
+				v.errorf(key, "paranoia level %d is not between 1 and 4", f)
+			case f < 0:
+				v.errorf(key, "%d cannot be negative", f)
+			case f == 0 && name != "ParanoiaLevel":
+				v.warnf(key, "0 cannot be sent to Fastly and keeps the current value, leave the setting out or give a value")
+			}
+		}
+	}
+
+	if set["ArgLength"] && set["TotalArgLength"] && o.TotalArgLength > 0 && o.ArgLength > o.TotalArgLength {
+		v.errorf("Owasp.ArgLength", "%d is more than TotalArgLength %d", o.ArgLength, o.TotalArgLength)
+	}
+	if set["MaxFileSize"] && set["CombinedFileSizes"] && o.CombinedFileSizes > 0 && o.MaxFileSize > o.CombinedFileSizes {
+		v.errorf("Owasp.MaxFileSize", "%d is more than CombinedFileSizes %d", o.MaxFileSize, o.CombinedFileSizes)
+	}
+}
+
+// validateConfig checks the effective config for the mistakes that would otherwise only show
+// up as a Fastly API error halfway through provisioning
+func validateConfig(config TOMLConfig, layered layeredConfig) []configProblem {
+	v := &configValidator{layered: layered}
+
+	//keys that no setting reads, most likely a typo
+	for _, key := range layered.Meta.Undecoded() {
+		v.errorf(key.String(), "unknown key")
+	}
+
+	switch config.Action {
+	case "", "disabled", "block", "log":
+	default:
+		v.errorf("Action", "%q is not one of: disabled, block, log", config.Action)
+	}
+	for _, p := range config.Publisher {
+		switch p {
+		case "owasp", "trustwave", "fastly":
+		default:
+			v.errorf("Publisher", "%q is not one of: owasp, trustwave, fastly", p)
+		}
+	}
+	lists := []struct {
+		Key string
+		IDs []int64
+	}{
+		{"Rules", config.Rules},
+		{"Provisioning.DisabledRules", config.Provisioning.DisabledRules},
+		{"Provisioning.LogRules", config.Provisioning.LogRules},
+		{"Provisioning.BlockRules", config.Provisioning.BlockRules},
+	}
+	listed := make(map[int64]string)
+	for _, list := range lists {
+		for _, id := range list.IDs {
+			if id <= 0 {
+				v.errorf(list.Key, "%d is not a rule ID", id)
+				continue
+			}
+			if other, ok := listed[id]; ok && other != list.Key {
+				v.warnf(list.Key, "rule %d is in %s and in %s", id, other, list.Key)
+				continue
+			}
+			listed[id] = list.Key
+		}
+	}
+
+	v.checkOWASPSettings(config.Owasp, owaspFields(layered))
+
+	if config.Weblog.Name != "" {
+		v.checkLogEndpoint("Weblog", config.Weblog.Address, config.Weblog.Port, config.Weblog.Tlscacert, config.Weblog.Format)
+	}
+	//the web log condition is pasted into the statement of the logging condition
+	if config.Weblog.Condition != "" {
+		v.checkVCLCondition("Weblog.Condition", config.Weblog.Condition)
+	}
+	if config.Waflog.Name != "" {
+		v.checkLogEndpoint("Waflog", config.Waflog.Address, config.Waflog.Port, config.Waflog.Tlscacert, config.Waflog.Format)
+	}
+
+	snippets := map[string]VCLSnippetSettings{"Vclsnippet": config.Vclsnippet}
+	for name, s := range config.AdditionalSnippets {
+		snippets["AdditionalSnippets."+name] = s
+	}
+	for key, s := range snippets {
+		if s.Name == "" {
+			continue
+		}
+		if !snippetTypes[s.Type] {
+			v.errorf(key+".Type", "%q is not a VCL snippet type", s.Type)
+		}
+		if s.Dynamic != 0 && s.Dynamic != 1 {
+			v.errorf(key+".Dynamic", "%d is not 0 or 1", s.Dynamic)
+		}
+		if s.Priority < 0 {
+			v.errorf(key+".Priority", "%d cannot be negative", s.Priority)
+		}
+		if strings.Count(s.Content, "{") != strings.Count(s.Content, "}") {
+			v.errorf(key+".Content", "unbalanced braces in the snippet")
+		}
+	}
+
+	if config.Response.Name != "" && (config.Response.HTTPStatusCode < 100 || config.Response.HTTPStatusCode > 599) {
+		v.errorf("Response.HTTPStatusCode", "%d is not an HTTP status code", config.Response.HTTPStatusCode)
+	}
+
+	if config.Prefetch.Name != "" {
+		if config.Prefetch.Type != "" && !strings.EqualFold(config.Prefetch.Type, "PREFETCH") {
+			v.errorf("Prefetch.Type", "%q is not PREFETCH", config.Prefetch.Type)
+		}
+		v.checkVCLCondition("Prefetch.Statement", config.Prefetch.Statement)
+	}
+
+	return v.problems
+}
+
+// reportConfigProblems logs the validation findings and tells whether the config is usable
+func reportConfigProblems(problems []configProblem) bool {
+	errors := 0
+	for _, p := range problems {
+		where := p.Key
+		if p.Source != "" {
+			where = fmt.Sprintf("%s (%s)", p.Key, p.Source)
+		}
+		if p.Warning {
+			Warning.Printf("%s: %s\n", where, p.Message)
+			continue
+		}
+		Error.Printf("%s: %s\n", where, p.Message)
+		errors++
+	}
+
+	if errors > 0 {
+		Error.Printf("Config validation found %d error(s) and %d warning(s)\n", errors, len(problems)-errors)
+		return false
+	}
+	Info.Printf("Config is valid with %d warning(s)\n", len(problems))
+	return true
+}
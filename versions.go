@@ -0,0 +1,284 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// versionDiff returns the text diff between two versions of a service
+func versionDiff(client *fastly.Client, serviceID string, from, to int) (string, bool) {
+	diff, err := client.GetDiff(&fastly.GetDiffInput{
+		Service: serviceID,
+		From:    from,
+		To:      to,
+		Format:  "text",
+	})
+	if err != nil {
+		Error.Printf("Cannot diff version %d to %d: GetDiff: %v\n", from, to, err)
+		return "", false
+	}
+	return diff.Diff, true
+}
+
+// diffStats counts the added and removed lines of a text diff
+func diffStats(diff string) (int, int) {
+	var added, removed int
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// abandonedVersions finds draft versions newer than the active one whose comment matches
+func abandonedVersions(client *fastly.Client, serviceID string, activeVersion int, match *regexp.Regexp) ([]*fastly.Version, bool) {
+	versions, err := client.ListVersions(&fastly.ListVersionsInput{
+		Service: serviceID,
+	})
+	if err != nil {
+		Error.Printf("Cannot list versions of service %q: ListVersions: %v\n", serviceID, err)
+		return nil, false
+	}
+
+	var drafts []*fastly.Version
+	for _, v := range versions {
+		if v.Number <= activeVersion || v.Active || v.Locked {
+			continue
+		}
+		if !match.MatchString(v.Comment) {
+			continue
+		}
+		drafts = append(drafts, v)
+	}
+	return drafts, true
+}
+
+// pruneVersions locks abandoned draft versions left behind by failed runs, showing the WAF related changes
+// of each first. The newest keep drafts and drafts changed less than olderThan ago are retained. The Fastly
+// API cannot delete versions, so pruned drafts are locked and their comment marks them as pruned.
+func pruneVersions(client *fastly.Client, serviceID string, activeVersion int, config TOMLConfig, pattern string, keep int, olderThan time.Duration, dryRun bool) bool {
+	match, err := regexp.Compile(pattern)
+	if err != nil {
+		Error.Printf("Invalid version comment pattern %q: %v\n", pattern, err)
+		return false
+	}
+
+	drafts, ok := abandonedVersions(client, serviceID, activeVersion, match)
+	if !ok {
+		return false
+	}
+
+	if len(drafts) == 0 {
+		Info.Printf("No abandoned draft versions newer than active version %d found\n", activeVersion)
+		return true
+	}
+	Info.Printf("Found %d abandoned draft version(s) newer than active version %d\n", len(drafts), activeVersion)
+
+	result := true
+	pruned := 0
+	for i := len(drafts) - 1; i >= 0; i-- {
+		v := drafts[i]
+
+		changed := "unknown"
+		if v.UpdatedAt != nil {
+			changed = v.UpdatedAt.Format("2006-01-02 15:04")
+		}
+
+		diff, ok := versionDiff(client, serviceID, activeVersion, v.Number)
+		if !ok {
+			result = false
+			continue
+		}
+		added, removed := diffStats(diff)
+		Info.Printf("- Version: %d\tChanged: %s\tComment: %q\tDiff to active: +%d -%d lines\n", v.Number, changed, v.Comment, added, removed)
+		if waf := filterWAFDiff(diff, wafDiffPattern(config)); strings.TrimSpace(waf) != "" {
+			fmt.Println(waf)
+		} else {
+			Info.Println("No WAF related changes")
+		}
+
+		//apply the retention policy
+		switch {
+		case len(drafts)-1-i < keep:
+			Info.Printf("Keeping version %d, it is one of the %d newest drafts\n", v.Number, keep)
+			continue
+		case olderThan > 0 && v.UpdatedAt != nil && time.Since(*v.UpdatedAt) < olderThan:
+			Info.Printf("Keeping version %d, it changed less than %s ago\n", v.Number, olderThan)
+			continue
+		case dryRun:
+			Info.Printf("Would prune version %d\n", v.Number)
+			continue
+		}
+
+		_, err := client.UpdateVersion(&fastly.UpdateVersionInput{
+			Service: serviceID,
+			Version: v.Number,
+			Comment: "Pruned by waflyctl: " + v.Comment,
+		})
+		if err != nil {
+			Error.Printf("Cannot update version %d: UpdateVersion: %v\n", v.Number, err)
+			result = false
+			continue
+		}
+
+		_, err = client.LockVersion(&fastly.LockVersionInput{
+			Service: serviceID,
+			Version: v.Number,
+		})
+		if err != nil {
+			Error.Printf("Cannot lock version %d: LockVersion: %v\n", v.Number, err)
+			result = false
+			continue
+		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   v.Number,
+			Resource:  "version",
+			Name:      strconv.Itoa(v.Number),
+			Action:    "lock",
+			Before:    v.Comment,
+			After:     "Pruned by waflyctl: " + v.Comment,
+		})
+		Info.Printf("Version %d pruned and locked\n", v.Number)
+		pruned++
+	}
+
+	Info.Printf("%d version(s) pruned\n", pruned)
+	return result
+}
+
+// wafDiffPattern matches diff lines that belong to WAF related objects of a service
+func wafDiffPattern(config TOMLConfig) *regexp.Regexp {
+	keys := []string{"waf", "snippet", "condition", "syslog", "response_object", "prefetch"}
+	names := []string{config.Prefetch.Name, config.Response.Name, config.Vclsnippet.Name, config.Weblog.Name, config.Waflog.Name}
+	for _, snippet := range config.AdditionalSnippets {
+		names = append(names, snippet.Name)
+	}
+	for _, name := range names {
+		if name != "" {
+			keys = append(keys, regexp.QuoteMeta(name))
+		}
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(keys, "|"))
+}
+
+// isDiffChange reports whether a diff line adds or removes content
+func isDiffChange(line string) bool {
+	if strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") {
+		return false
+	}
+	return strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-")
+}
+
+// diffIndent measures the indentation of a diff line without its change marker
+func diffIndent(line string) int {
+	if len(line) > 0 && (line[0] == '+' || line[0] == '-' || line[0] == ' ') {
+		line = line[1:]
+	}
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// filterWAFDiff keeps the changes of a diff that touch WAF related objects, either in the changed lines
+// or in the objects enclosing them. Each change block is kept with a few lines of context and the
+// enclosing line that names the object it belongs to.
+func filterWAFDiff(diff string, match *regexp.Regexp) string {
+	const context = 3
+	lines := strings.Split(diff, "\n")
+
+	var out []string
+	last := -1
+	for i := 0; i < len(lines); i++ {
+		if !isDiffChange(lines[i]) {
+			continue
+		}
+
+		//find the end of the change block
+		end := i
+		for end+1 < len(lines) && isDiffChange(lines[end+1]) {
+			end++
+		}
+
+		//walk up the enclosing objects of the block, the nearest one is shown as its header
+		related := false
+		for j := i; j <= end && !related; j++ {
+			related = match.MatchString(lines[j])
+		}
+		indent := diffIndent(lines[i])
+		header := -1
+		for j := i - 1; j >= 0 && indent > 0; j-- {
+			if isDiffChange(lines[j]) || strings.TrimSpace(lines[j]) == "" || diffIndent(lines[j]) >= indent {
+				continue
+			}
+			if header < 0 {
+				header = j
+			}
+			related = related || match.MatchString(lines[j])
+			indent = diffIndent(lines[j])
+		}
+
+		from := i - context
+		if from < 0 {
+			from = 0
+		}
+		to := end + context
+		if to >= len(lines) {
+			to = len(lines) - 1
+		}
+
+		if related {
+			if from <= last {
+				from = last + 1
+			} else {
+				if len(out) > 0 {
+					out = append(out, "...")
+				}
+				if header >= 0 && header < from {
+					out = append(out, lines[header])
+				}
+			}
+			out = append(out, lines[from:to+1]...)
+			last = to
+		}
+		i = end
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// showVersionDiff prints the WAF related changes between two versions of a service
+func showVersionDiff(client *fastly.Client, serviceID string, from, to int, config TOMLConfig, all bool) bool {
+	diff, ok := versionDiff(client, serviceID, from, to)
+	if !ok {
+		return false
+	}
+
+	added, removed := diffStats(diff)
+	if !all {
+		diff = filterWAFDiff(diff, wafDiffPattern(config))
+	}
+	wafAdded, wafRemoved := diffStats(diff)
+
+	Info.Printf("Diff of version %d to %d: +%d -%d lines, +%d -%d in WAF related objects\n", from, to, added, removed, wafAdded, wafRemoved)
+	if strings.TrimSpace(diff) == "" {
+		Info.Println("No WAF related changes")
+		return true
+	}
+	fmt.Println(diff)
+	return true
+}
@@ -0,0 +1,126 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFilterWAFDiff(t *testing.T) {
+	match := regexp.MustCompile(`(?i)waf`)
+	tests := []struct {
+		name string
+		diff []string
+		want []string
+	}{
+		{
+			name: "unrelated change",
+			diff: []string{
+				" backends:",
+				"   - name: origin",
+				"-    port: 80",
+				"+    port: 443",
+			},
+			want: nil,
+		},
+		{
+			name: "changed line names a WAF object",
+			diff: []string{
+				" conditions:",
+				"-  - name: waf-soc-logging",
+				"+  - name: waf-soc-logging-with-expiry",
+			},
+			want: []string{
+				" conditions:",
+				"-  - name: waf-soc-logging",
+				"+  - name: waf-soc-logging-with-expiry",
+			},
+		},
+		{
+			name: "change inside a WAF object",
+			diff: []string{
+				" snippets:",
+				"   - name: waf-soc-config",
+				"     content: |",
+				"       set x = 1;",
+				"-      set y = 2;",
+				"+      set y = 3;",
+			},
+			want: []string{
+				"   - name: waf-soc-config",
+				"     content: |",
+				"       set x = 1;",
+				"-      set y = 2;",
+				"+      set y = 3;",
+			},
+		},
+		{
+			name: "header of a WAF object outside the context",
+			diff: []string{
+				" wafs:",
+				"   - id: waf1",
+				"     rules:",
+				"       a",
+				"       b",
+				"       c",
+				"       d",
+				"-      e",
+				"+      f",
+				"       g",
+			},
+			want: []string{
+				"     rules:",
+				"       b",
+				"       c",
+				"       d",
+				"-      e",
+				"+      f",
+				"       g",
+			},
+		},
+		{
+			name: "separate blocks",
+			diff: []string{
+				" headers:",
+				"-  - name: waf-header",
+				"   - name: x",
+				"   - name: y",
+				"   - name: z",
+				"   - name: w",
+				"   - name: v",
+				"+  - name: origin",
+				" snippets:",
+				"   - name: x",
+				"   - name: y",
+				"   - name: z",
+				"-  - name: waf-snippet",
+			},
+			want: []string{
+				" headers:",
+				"-  - name: waf-header",
+				"   - name: x",
+				"   - name: y",
+				"   - name: z",
+				"...",
+				" snippets:",
+				"   - name: x",
+				"   - name: y",
+				"   - name: z",
+				"-  - name: waf-snippet",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := filterWAFDiff(strings.Join(tt.diff, "\n"), match)
+		if want := strings.Join(tt.want, "\n"); got != want {
+			t.Errorf("%s: filterWAFDiff() =\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
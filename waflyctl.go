@@ -9,7 +9,6 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
@@ -24,7 +23,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/fastly/go-fastly/fastly"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/resty.v1"
@@ -48,15 +46,19 @@ var (
 	date    = "unknown"
 )
 
+// defaultVersionComment is set on versions cloned without a --comment
+const defaultVersionComment = "Created by waflyctl"
+
 // TOMLConfig is the applications config file
 type TOMLConfig struct {
+	SchemaVersion      int `toml:"schema_version" json:"schema_version" yaml:"schema_version"`
 	Logpath            string
-	APIEndpoint        string
+	APIEndpoint        string `toml:"-" json:"-" yaml:"-"`
 	Tags               []string
 	Publisher          []string
 	Action             string
 	Rules              []int64
-	DisabledRules      []int64
+	Provisioning       ProvisioningSettings
 	Owasp              owaspSettings
 	Weblog             WeblogSettings
 	Waflog             WaflogSettings
@@ -107,6 +109,14 @@ type owaspSettings struct {
 	WarningAnomalyScore              int
 }
 
+// ProvisioningSettings are only applied when a new WAF is provisioned. LogRules and BlockRules hold
+// the rules that need the other action than Action.
+type ProvisioningSettings struct {
+	DisabledRules []int64
+	LogRules      []int64
+	BlockRules    []int64
+}
+
 // WeblogSettings parameters for logs in config file
 type WeblogSettings struct {
 	Name        string
@@ -117,6 +127,7 @@ type WeblogSettings struct {
 	Format      string
 	Condition   string
 	Expiry      uint
+	PerimeterX  bool
 }
 
 // VCLSnippetSettings parameters for snippets in config file
@@ -238,12 +249,12 @@ type PatchRulesStatusCheck struct {
 	}
 }
 
-//Init function starts our logger
-func Init(configFile string) TOMLConfig {
+// Init function starts our logger
+func Init(configFile string, overlays []string, serviceID string, cli map[string]interface{}) (TOMLConfig, layeredConfig) {
 
 	//load configs
-	var config TOMLConfig
-	if _, err := toml.DecodeFile(configFile, &config); err != nil {
+	config, layered, err := loadConfig(configFile, overlays, serviceID, cli)
+	if err != nil {
 		fmt.Println("Could not read config file -", err)
 		os.Exit(1)
 	}
@@ -281,7 +292,15 @@ func Init(configFile string) TOMLConfig {
 		"ERROR: ",
 		log.Ldate|log.Ltime|log.Lshortfile)
 
-	return config
+	//old configs keep working, the settings they use are deprecated
+	for _, w := range layered.Warnings {
+		Warning.Println(w)
+	}
+	if len(layered.Warnings) > 0 {
+		Warning.Println("Upgrade the config with --migrate-config to remove these warnings")
+	}
+
+	return config, layered
 }
 
 func getActiveVersion(client *fastly.Client, serviceID string) int {
@@ -309,18 +328,81 @@ func cloneVersion(client *fastly.Client, serviceID string, activeVersion int, co
 		Error.Fatalf("Cannot clone version %d: CloneVersion: %v\n", activeVersion, err)
 	}
 
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version.Number,
+		Resource:  "version",
+		Name:      strconv.Itoa(version.Number),
+		Action:    "clone",
+		Before:    activeVersion,
+		After:     version.Number,
+	})
+
+	//tag the version so abandoned drafts can be found by --prune-versions
 	if comment == "" {
-		Info.Printf("New version %d created\n", version.Number)
-	} else {
-		client.UpdateVersion(&fastly.UpdateVersionInput{
+		comment = defaultVersionComment
+	}
+	client.UpdateVersion(&fastly.UpdateVersionInput{
+		Service: serviceID,
+		Version: version.Number,
+		Comment: comment,
+	})
+	Info.Printf("New version %d created. Comment: %s\n", version.Number, comment)
+
+	return version.Number
+}
+
+// getVersion looks up a service version by number or "latest"
+func getVersion(client *fastly.Client, serviceID, requested string) *fastly.Version {
+	if requested == "latest" {
+		latest, err := client.LatestVersion(&fastly.LatestVersionInput{
 			Service: serviceID,
-			Version: version.Number,
-			Comment: comment,
 		})
-		Info.Printf("New version %d created. Comment: %s\n", version.Number, comment)
+		if err != nil {
+			Error.Fatalf("Cannot get latest version of service %q: LatestVersion: %v\n", serviceID, err)
+		}
+		return latest
+	}
+
+	number, err := strconv.Atoi(requested)
+	if err != nil || number <= 0 {
+		Error.Fatalf("Invalid service version %q, use a version number or latest\n", requested)
+	}
+	version, err := client.GetVersion(&fastly.GetVersionInput{
+		Service: serviceID,
+		Version: number,
+	})
+	if err != nil {
+		Error.Fatalf("Cannot get version %d: GetVersion: %v\n", number, err)
+	}
+	return version
+}
+
+// draftVersion returns the version a versioned operation edits. Without a requested version the active
+// version is cloned. A requested draft is edited in place, a locked or active one is cloned first.
+func draftVersion(client *fastly.Client, serviceID string, activeVersion int, requested, comment string) int {
+	if requested == "" {
+		return cloneVersion(client, serviceID, activeVersion, comment)
+	}
 
+	version := getVersion(client, serviceID, requested)
+	switch {
+	case version.Active:
+		Warning.Printf("Version %d is active and cannot be edited, cloning it\n", version.Number)
+		return cloneVersion(client, serviceID, version.Number, comment)
+	case version.Locked:
+		Warning.Printf("Version %d is locked and cannot be edited, cloning it\n", version.Number)
+		return cloneVersion(client, serviceID, version.Number, comment)
 	}
 
+	Info.Printf("Editing draft version %d\n", version.Number)
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version.Number,
+		Resource:  "version",
+		Name:      strconv.Itoa(version.Number),
+		Action:    "edit",
+	})
 	return version.Number
 }
 
@@ -346,6 +428,14 @@ func prefetchCondition(client *fastly.Client, serviceID string, config TOMLConfi
 			Error.Fatalf("Cannot create prefetch condition %q: CreateCondition: %v\n", config.Prefetch.Name, err)
 		}
 		Info.Printf("Prefetch condition %q created\n", config.Prefetch.Name)
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "condition",
+			Name:      config.Prefetch.Name,
+			Action:    "create",
+			After:     config.Prefetch,
+		})
 	} else {
 		Warning.Printf("Prefetch condition %q already exists, skipping\n", config.Prefetch.Name)
 	}
@@ -379,6 +469,14 @@ func responseObject(client *fastly.Client, serviceID string, config TOMLConfig,
 		Error.Fatalf("Cannot create response object %q: CreateResponseObject: %v\n", config.Response.Name, err)
 	}
 	Info.Printf("Response object %q created\n", config.Response.Name)
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version,
+		Resource:  "response_object",
+		Name:      config.Response.Name,
+		Action:    "create",
+		After:     config.Response,
+	})
 }
 
 func vclSnippet(client *fastly.Client, serviceID string, vclSnippet VCLSnippetSettings, version int) {
@@ -408,6 +506,14 @@ func vclSnippet(client *fastly.Client, serviceID string, vclSnippet VCLSnippetSe
 		Error.Fatalf("Cannot create VCL snippet %q: CreateSnippet: %v\n", vclSnippet.Name, err)
 	}
 	Info.Printf("VCL snippet %q created\n", vclSnippet.Name)
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version,
+		Resource:  "snippet",
+		Name:      vclSnippet.Name,
+		Action:    "create",
+		After:     vclSnippet,
+	})
 }
 
 func fastlyLogging(client *fastly.Client, serviceID string, config TOMLConfig, version int) {
@@ -429,6 +535,14 @@ func fastlyLogging(client *fastly.Client, serviceID string, config TOMLConfig, v
 		switch {
 		case err == nil:
 			Info.Printf("Logging endpoint %q created\n", config.Weblog.Name)
+			recordChange(JournalEntry{
+				ServiceID: serviceID,
+				Version:   version,
+				Resource:  "syslog",
+				Name:      config.Weblog.Name,
+				Action:    "create",
+				After:     config.Weblog,
+			})
 		case strings.Contains(err.Error(), "Duplicate record"):
 			Warning.Printf("Logging endpoint %q already exists, skipping\n", config.Weblog.Name)
 		default:
@@ -456,6 +570,14 @@ func fastlyLogging(client *fastly.Client, serviceID string, config TOMLConfig, v
 		switch {
 		case err == nil:
 			Info.Printf("Logging endpoint %q created\n", config.Waflog.Name)
+			recordChange(JournalEntry{
+				ServiceID: serviceID,
+				Version:   version,
+				Resource:  "syslog",
+				Name:      config.Waflog.Name,
+				Action:    "create",
+				After:     config.Waflog,
+			})
 		case strings.Contains(err.Error(), "Duplicate record"):
 			Warning.Printf("Logging endpoint %q already exists, skipping\n", config.Waflog.Name)
 		default:
@@ -477,17 +599,34 @@ func wafContainer(client *fastly.Client, serviceID string, config TOMLConfig, ve
 		Error.Fatalf("Cannot create WAF: CreateWAF: %v\n", err)
 	}
 	Info.Printf("WAF %q created\n", waf.ID)
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		WAFID:     waf.ID,
+		Version:   version,
+		Resource:  "waf",
+		Name:      waf.ID,
+		Action:    "create",
+		After: map[string]string{
+			"prefetch_condition": config.Prefetch.Name,
+			"response":           config.Response.Name,
+		},
+	})
 	return waf.ID
 }
 
-func createOWASP(client *fastly.Client, serviceID string, config TOMLConfig, wafID string) {
+func createOWASP(client *fastly.Client, serviceID string, config TOMLConfig, wafID string, fields []string) {
 	var created bool
 	var err error
+	var before interface{}
+	var current owaspSettings
 	owasp, _ := client.GetOWASP(&fastly.GetOWASPInput{
 		Service: serviceID,
 		ID:      wafID,
 	})
-	if owasp.ID == "" {
+	if owasp.ID != "" {
+		current = owaspFromFastly(owasp)
+		before = current
+	} else {
 		owasp, err = client.CreateOWASP(&fastly.CreateOWASPInput{
 			Service: serviceID,
 			ID:      wafID,
@@ -496,42 +635,32 @@ func createOWASP(client *fastly.Client, serviceID string, config TOMLConfig, waf
 			Error.Fatalf("%v\n", err)
 		}
 		created = true
+		current = owaspFromFastly(owasp)
 	}
-	owasp, err = client.UpdateOWASP(&fastly.UpdateOWASPInput{
-		Service:                          serviceID,
-		ID:                               wafID,
-		OWASPID:                          owasp.ID,
-		AllowedHTTPVersions:              config.Owasp.AllowedHTTPVersions,
-		AllowedMethods:                   config.Owasp.AllowedMethods,
-		AllowedRequestContentType:        config.Owasp.AllowedRequestContentType,
-		AllowedRequestContentTypeCharset: config.Owasp.AllowedRequestContentTypeCharset,
-		ArgLength:                        config.Owasp.ArgLength,
-		ArgNameLength:                    config.Owasp.ArgNameLength,
-		CombinedFileSizes:                config.Owasp.CombinedFileSizes,
-		CriticalAnomalyScore:             config.Owasp.CriticalAnomalyScore,
-		CRSValidateUTF8Encoding:          config.Owasp.CRSValidateUTF8Encoding,
-		ErrorAnomalyScore:                config.Owasp.ErrorAnomalyScore,
-		HTTPViolationScoreThreshold:      config.Owasp.HTTPViolationScoreThreshold,
-		InboundAnomalyScoreThreshold:     config.Owasp.InboundAnomalyScoreThreshold,
-		LFIScoreThreshold:                config.Owasp.LFIScoreThreshold,
-		MaxFileSize:                      config.Owasp.MaxFileSize,
-		MaxNumArgs:                       config.Owasp.MaxNumArgs,
-		NoticeAnomalyScore:               config.Owasp.NoticeAnomalyScore,
-		ParanoiaLevel:                    config.Owasp.ParanoiaLevel,
-		PHPInjectionScoreThreshold:       config.Owasp.PHPInjectionScoreThreshold,
-		RCEScoreThreshold:                config.Owasp.RCEScoreThreshold,
-		RestrictedExtensions:             config.Owasp.RestrictedExtensions,
-		RestrictedHeaders:                config.Owasp.RestrictedHeaders,
-		RFIScoreThreshold:                config.Owasp.RFIScoreThreshold,
-		SessionFixationScoreThreshold:    config.Owasp.SessionFixationScoreThreshold,
-		SQLInjectionScoreThreshold:       config.Owasp.SQLInjectionScoreThreshold,
-		XSSScoreThreshold:                config.Owasp.XSSScoreThreshold,
-		TotalArgLength:                   config.Owasp.TotalArgLength,
-		WarningAnomalyScore:              config.Owasp.WarningAnomalyScore,
-	})
+
+	//only the settings present in the config are sent
+	attributes := owaspUpdate(current, config.Owasp, fields)
+	if len(attributes) == 0 {
+		if created {
+			Info.Println("OWASP settings created with the Fastly defaults")
+		} else {
+			Info.Println("OWASP settings already match the config")
+		}
+		return
+	}
+	owasp, err = updateOWASP(client, serviceID, wafID, owasp.ID, attributes)
 	if err != nil {
 		Error.Fatalf("%v\n", err)
 	}
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		WAFID:     wafID,
+		Resource:  "owasp",
+		Name:      owasp.ID,
+		Action:    "update",
+		Before:    before,
+		After:     owaspFromFastly(owasp),
+	})
 	if created {
 		Info.Println("OWASP settings created with the following settings:")
 	} else {
@@ -565,6 +694,39 @@ func createOWASP(client *fastly.Client, serviceID string, config TOMLConfig, waf
 	Info.Println(" - WarningAnomalyScore:", owasp.WarningAnomalyScore)
 }
 
+// owaspFromFastly converts the OWASP object of the Fastly API into config file settings
+func owaspFromFastly(owasp *fastly.OWASP) owaspSettings {
+	return owaspSettings{
+		AllowedHTTPVersions:              owasp.AllowedHTTPVersions,
+		AllowedMethods:                   owasp.AllowedMethods,
+		AllowedRequestContentType:        owasp.AllowedRequestContentType,
+		AllowedRequestContentTypeCharset: owasp.AllowedRequestContentTypeCharset,
+		ArgLength:                        owasp.ArgLength,
+		ArgNameLength:                    owasp.ArgNameLength,
+		CombinedFileSizes:                owasp.CombinedFileSizes,
+		CriticalAnomalyScore:             owasp.CriticalAnomalyScore,
+		CRSValidateUTF8Encoding:          owasp.CRSValidateUTF8Encoding,
+		ErrorAnomalyScore:                owasp.ErrorAnomalyScore,
+		HTTPViolationScoreThreshold:      owasp.HTTPViolationScoreThreshold,
+		InboundAnomalyScoreThreshold:     owasp.InboundAnomalyScoreThreshold,
+		LFIScoreThreshold:                owasp.LFIScoreThreshold,
+		MaxFileSize:                      owasp.MaxFileSize,
+		MaxNumArgs:                       owasp.MaxNumArgs,
+		NoticeAnomalyScore:               owasp.NoticeAnomalyScore,
+		ParanoiaLevel:                    owasp.ParanoiaLevel,
+		PHPInjectionScoreThreshold:       owasp.PHPInjectionScoreThreshold,
+		RCEScoreThreshold:                owasp.RCEScoreThreshold,
+		RestrictedExtensions:             owasp.RestrictedExtensions,
+		RestrictedHeaders:                owasp.RestrictedHeaders,
+		RFIScoreThreshold:                owasp.RFIScoreThreshold,
+		SessionFixationScoreThreshold:    owasp.SessionFixationScoreThreshold,
+		SQLInjectionScoreThreshold:       owasp.SQLInjectionScoreThreshold,
+		XSSScoreThreshold:                owasp.XSSScoreThreshold,
+		TotalArgLength:                   owasp.TotalArgLength,
+		WarningAnomalyScore:              owasp.WarningAnomalyScore,
+	}
+}
+
 // DeleteLogsCall removes logging endpoints and any logging conditions.
 func DeleteLogsCall(client *fastly.Client, serviceID string, config TOMLConfig, version int) bool {
 
@@ -590,6 +752,13 @@ func DeleteLogsCall(client *fastly.Client, serviceID string, config TOMLConfig,
 			fmt.Println(err)
 			return false
 		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "syslog",
+			Name:      config.Weblog.Name,
+			Action:    "delete",
+		})
 	}
 
 	if sysLogExists(slogs, config.Waflog.Name) {
@@ -603,6 +772,13 @@ func DeleteLogsCall(client *fastly.Client, serviceID string, config TOMLConfig,
 			fmt.Println(err)
 			return false
 		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "syslog",
+			Name:      config.Waflog.Name,
+			Action:    "delete",
+		})
 	}
 
 	//first find if we have any PX conditions
@@ -627,6 +803,13 @@ func DeleteLogsCall(client *fastly.Client, serviceID string, config TOMLConfig,
 			Error.Println(err)
 			return false
 		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "condition",
+			Name:      "waf-soc-logging",
+			Action:    "delete",
+		})
 	}
 	if conditionExists(conditions, "waf-soc-logging-with-expiry") {
 		Info.Println("Deleting logging condition: 'waf-soc-logging-with-expiry'")
@@ -639,6 +822,13 @@ func DeleteLogsCall(client *fastly.Client, serviceID string, config TOMLConfig,
 			Error.Println(err)
 			return false
 		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "condition",
+			Name:      "waf-soc-logging-with-expiry",
+			Action:    "delete",
+		})
 	}
 
 	//Legacy conditions
@@ -654,6 +844,13 @@ func DeleteLogsCall(client *fastly.Client, serviceID string, config TOMLConfig,
 			Error.Println(err)
 			return false
 		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "condition",
+			Name:      "waf-soc-with-px",
+			Action:    "delete",
+		})
 
 	}
 
@@ -669,6 +866,13 @@ func DeleteLogsCall(client *fastly.Client, serviceID string, config TOMLConfig,
 			Error.Println(err)
 			return false
 		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "condition",
+			Name:      "waf-soc-with-shielding",
+			Action:    "delete",
+		})
 	}
 
 	return true
@@ -697,13 +901,60 @@ func sysLogExists(slogs []*fastly.Syslog, name string) bool {
 	return false
 }
 
-// DeprovisionWAF removes a WAF from a service
-func DeprovisionWAF(client *fastly.Client, serviceID, apiKey string, config TOMLConfig, version int) bool {
+// selectWAFs picks the WAF objects an operation applies to. A service with several WAF objects
+// needs an explicit --waf-id or --all-wafs.
+func selectWAFs(wafs []*fastly.WAF, wafID string, all bool) ([]*fastly.WAF, bool) {
+	if wafID != "" {
+		for _, waf := range wafs {
+			if waf.ID == wafID {
+				return []*fastly.WAF{waf}, true
+			}
+		}
+		Error.Printf("WAF %s not found on this service\n", wafID)
+		return nil, false
+	}
+
+	if len(wafs) > 1 && !all {
+		Error.Printf("Service has %d WAF objects, select one with --waf-id or use --all-wafs:\n", len(wafs))
+		for _, waf := range wafs {
+			Error.Printf("- WAF ID: %s\n", waf.ID)
+		}
+		return nil, false
+	}
+
+	return wafs, true
+}
+
+// listWAFs shows every WAF object of a service version
+func listWAFs(wafs []*fastly.WAF) {
+	if len(wafs) == 0 {
+		Warning.Println("No WAF objects found")
+		return
+	}
+
+	for index, waf := range wafs {
+		configSet := "-"
+		if waf.ConfigurationSet != nil {
+			configSet = waf.ConfigurationSet.ID
+		}
+		lastPush := "never"
+		if waf.LastPush != nil {
+			lastPush = waf.LastPush.Format(time.RFC3339)
+		}
+		Info.Printf("- WAF #%v ID: %s\tPrefetch Condition: %s\tResponse: %s\tConfiguration Set: %s\tLast Push: %s\n",
+			index+1, waf.ID, waf.PrefetchCondition, waf.Response, configSet, lastPush)
+	}
+}
+
+// DeprovisionWAF removes the selected WAF objects from a service. Logging and the VCL snippet are
+// shared by all WAF objects and only go once no WAF is left.
+func DeprovisionWAF(client *fastly.Client, serviceID, apiKey string, config TOMLConfig, version int, wafID string, all bool) bool {
 	/*
 		To Remove
-		1. Delete response
-		2. Delete prefetch
-		3. Delete WAF
+		1. Delete WAF
+		2. Delete response
+		3. Delete prefetch
+		4. Delete logging and snippet once no WAF is left
 	*/
 
 	//get current waf objects
@@ -722,8 +973,12 @@ func DeprovisionWAF(client *fastly.Client, serviceID, apiKey string, config TOML
 		return false
 	}
 
-	//get list of conditions
-	//first find if we have any PX conditions
+	selected, ok := selectWAFs(wafs, wafID, all)
+	if !ok {
+		return false
+	}
+
+	//get list of conditions and response objects
 	conditions, err := client.ListConditions(&fastly.ListConditionsInput{
 		Service: serviceID,
 		Version: version,
@@ -733,16 +988,36 @@ func DeprovisionWAF(client *fastly.Client, serviceID, apiKey string, config TOML
 		return false
 	}
 
-	for index, waf := range wafs {
+	responses, err := client.ListResponseObjects(&fastly.ListResponseObjectsInput{
+		Service: serviceID,
+		Version: version,
+	})
+	if err != nil {
+		Error.Fatal(err)
+		return false
+	}
 
-		//remove WAF Logging
-		result := DeleteLogsCall(client, serviceID, config, version)
-		Info.Printf("Deleting WAF #%v Logging\n", index+1)
-		if !result {
-			Error.Printf("Deleting WAF #%v Logging.\n", index+1)
+	//objects still referenced by a WAF that stays must not be removed
+	remaining := make(map[string]bool)
+	for _, waf := range wafs {
+		remaining[waf.ID] = true
+	}
+	for _, waf := range selected {
+		delete(remaining, waf.ID)
+	}
+	inUse := func(pick func(*fastly.WAF) string, name string) bool {
+		for _, waf := range wafs {
+			if remaining[waf.ID] && strings.EqualFold(pick(waf), name) {
+				return true
+			}
 		}
+		return false
+	}
+	deleted := make(map[string]bool)
+
+	for index, waf := range selected {
 
-		Info.Printf("Deleting WAF #%v Container\n", index+1)
+		Info.Printf("Deleting WAF #%v (%s) Container\n", index+1, waf.ID)
 		//remove WAF container
 		err = client.DeleteWAF(&fastly.DeleteWAFInput{
 			Service: serviceID,
@@ -753,53 +1028,112 @@ func DeprovisionWAF(client *fastly.Client, serviceID, apiKey string, config TOML
 			Error.Print(err)
 			return false
 		}
-
-		//remove WAF Response Object
-		Info.Printf("Deleting WAF #%v Response Object\n", index+1)
-		err = client.DeleteResponseObject(&fastly.DeleteResponseObjectInput{
-			Service: serviceID,
-			Version: version,
-			Name:    "WAF_Response",
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			WAFID:     waf.ID,
+			Version:   version,
+			Resource:  "waf",
+			Name:      waf.ID,
+			Action:    "delete",
+			Before: map[string]string{
+				"prefetch_condition": waf.PrefetchCondition,
+				"response":           waf.Response,
+			},
 		})
-		if err != nil {
-			Error.Print(err)
-			return false
+
+		//remove WAF Response Object (if exists and no other WAF uses it)
+		response := waf.Response
+		if response != "" && !deleted["response:"+response] && !inUse(func(w *fastly.WAF) string { return w.Response }, response) {
+			for _, r := range responses {
+				if !strings.EqualFold(r.Name, response) {
+					continue
+				}
+				Info.Printf("Deleting WAF #%v Response Object %q\n", index+1, r.Name)
+				err = client.DeleteResponseObject(&fastly.DeleteResponseObjectInput{
+					Service: serviceID,
+					Version: version,
+					Name:    r.Name,
+				})
+				if err != nil {
+					Error.Print(err)
+					return false
+				}
+				recordChange(JournalEntry{
+					ServiceID: serviceID,
+					WAFID:     waf.ID,
+					Version:   version,
+					Resource:  "response_object",
+					Name:      r.Name,
+					Action:    "delete",
+				})
+				deleted["response:"+response] = true
+			}
 		}
 
-		//remove WAF Prefetch condition (if exists)
-		if conditionExists(conditions, "WAF_Prefetch") {
-			Info.Printf("Deleting WAF #%v Prefetch Condition\n", index+1)
+		//remove WAF Prefetch condition (if exists and no other WAF uses it)
+		prefetch := waf.PrefetchCondition
+		if prefetch != "" && !deleted["condition:"+prefetch] && conditionExists(conditions, prefetch) &&
+			!inUse(func(w *fastly.WAF) string { return w.PrefetchCondition }, prefetch) {
+			Info.Printf("Deleting WAF #%v Prefetch Condition %q\n", index+1, prefetch)
 			err = client.DeleteCondition(&fastly.DeleteConditionInput{
 				Service: serviceID,
 				Version: version,
-				Name:    "WAF_Prefetch",
+				Name:    prefetch,
 			})
 			if err != nil {
 				Error.Print(err)
 				return false
 			}
+			recordChange(JournalEntry{
+				ServiceID: serviceID,
+				WAFID:     waf.ID,
+				Version:   version,
+				Resource:  "condition",
+				Name:      prefetch,
+				Action:    "delete",
+			})
+			deleted["condition:"+prefetch] = true
 		}
+	}
 
-		//remove VCL Snippet
-		Info.Printf("Deleting WAF #%v VCL Snippet\n", index+1)
-		apiCall := config.APIEndpoint + "/service/" + serviceID + "/version/" + strconv.Itoa(version) + "/snippet/" + config.Vclsnippet.Name
-		//get list of current snippets
-		_, err := resty.R().
-			SetHeader("Accept", "application/json").
-			SetHeader("Fastly-Key", apiKey).
-			Delete(apiCall)
+	if len(remaining) > 0 {
+		Info.Printf("%d WAF object(s) remain on the service, keeping logging and VCL snippet\n", len(remaining))
+		return true
+	}
 
-		//check if we had an issue with our call
-		if err != nil {
-			Error.Printf("Deleting WAF #%v VCL Snippet\n", index+1)
-		}
+	//remove WAF Logging
+	Info.Println("Deleting WAF Logging")
+	if !DeleteLogsCall(client, serviceID, config, version) {
+		Error.Println("Deleting WAF Logging.")
+	}
 
+	//remove VCL Snippet
+	Info.Println("Deleting WAF VCL Snippet")
+	apiCall := config.APIEndpoint + "/service/" + serviceID + "/version/" + strconv.Itoa(version) + "/snippet/" + config.Vclsnippet.Name
+	_, err = resty.R().
+		SetHeader("Accept", "application/json").
+		SetHeader("Fastly-Key", apiKey).
+		Delete(apiCall)
+
+	//check if we had an issue with our call
+	if err != nil {
+		Error.Println("Deleting WAF VCL Snippet")
+	} else {
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "snippet",
+			Name:      config.Vclsnippet.Name,
+			Action:    "delete",
+		})
 	}
 
 	return true
 }
 
-func provisionWAF(client *fastly.Client, serviceID string, config TOMLConfig, version int) string {
+// provisionWAF creates the WAF objects of a config on a version and returns the ID of the new WAF. The
+// logging endpoints and their condition are left out with omitLogs.
+func provisionWAF(client *fastly.Client, serviceID string, config TOMLConfig, version int, owaspKeys []string, omitLogs, withPX bool) string {
 	prefetchCondition(client, serviceID, config, version)
 
 	responseObject(client, serviceID, config, version)
@@ -814,10 +1148,13 @@ func provisionWAF(client *fastly.Client, serviceID string, config TOMLConfig, ve
 
 	wafID := wafContainer(client, serviceID, config, version)
 
-	createOWASP(client, serviceID, config, wafID)
+	createOWASP(client, serviceID, config, wafID, owaspKeys)
 
-	if !*omitLogs {
+	if !omitLogs {
 		fastlyLogging(client, serviceID, config, version)
+		if config.Weblog.Name != "" {
+			AddLoggingCondition(client, serviceID, version, config, withPX)
+		}
 	}
 
 	return wafID
@@ -841,8 +1178,26 @@ func validateVersion(client *fastly.Client, serviceID string, version int) bool
 
 }
 
+// finishVersion summarises the WAF related changes of a versioned operation and validates the version
+// unless more steps will follow
+func finishVersion(client *fastly.Client, serviceID string, activeVersion, version int, config TOMLConfig) bool {
+	showVersionDiff(client, serviceID, activeVersion, version, config, false)
+
+	if *noValidate {
+		Info.Printf("Skipping validation of version %v, validate it with the last operation\n", version)
+		return true
+	}
+	return validateVersion(client, serviceID, version)
+}
+
 func publisherConfig(apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig) bool {
 
+	//snapshot rule statuses for the audit journal
+	var before map[string]string
+	if journal != nil {
+		before, _ = getRuleStatuses(apiEndpoint, apiKey, serviceID, wafID)
+	}
+
 	for _, publisher := range config.Publisher {
 
 		if publisher == "" {
@@ -931,6 +1286,7 @@ func publisherConfig(apiEndpoint, apiKey, serviceID, wafID string, config TOMLCo
 				//check if our response was ok
 				if resp.Status() == "200 OK" {
 					Info.Printf("Rule %s was configured in the WAF with action %s\n", r.ID, config.Action)
+					recordRuleStatus(serviceID, wafID, r.ID, before[r.ID], config.Action)
 				} else {
 					Error.Printf("Could not set status: %s on rule tag: %s the response was: %s\n", config.Action, r.ID, resp.String())
 				}
@@ -948,6 +1304,12 @@ func tagsConfig(apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig,
 	//API Endpoint to call for domain searches
 	apiCall := apiEndpoint + "/wafs/tags"
 
+	//snapshot rule statuses for the audit journal
+	var before map[string]string
+	if journal != nil {
+		before, _ = getRuleStatuses(apiEndpoint, apiKey, serviceID, wafID)
+	}
+
 	//make the call
 	ruleList := RuleList{}
 	for _, tag := range config.Tags {
@@ -1021,9 +1383,15 @@ func tagsConfig(apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig,
 
 	Info.Printf("Total %d rule(s) added via tags\n", len(ruleList.Data))
 
+	if journal != nil && len(ruleList.Data) > 0 {
+		after, _ := getRuleStatuses(apiEndpoint, apiKey, serviceID, wafID)
+		recordRuleStatusChanges(serviceID, wafID, before, after)
+	}
+
 }
 
-func changeStatus(apiEndpoint, apiKey, wafID, status string) {
+// changeStatus enables or disables a WAF, previous is its status before the change for the audit journal
+func changeStatus(apiEndpoint, apiKey, wafID, previous, status string) {
 	apiCall := apiEndpoint + "/wafs/" + wafID + "/" + status
 
 	resp, err := resty.R().
@@ -1043,6 +1411,14 @@ func changeStatus(apiEndpoint, apiKey, wafID, status string) {
 	//check if our response was ok
 	if resp.Status() == "202 Accepted" {
 		Info.Printf("WAF %s status was changed to %s\n", wafID, status)
+		recordChange(JournalEntry{
+			WAFID:    wafID,
+			Resource: "waf_status",
+			Name:     wafID,
+			Action:   "update",
+			Before:   previous,
+			After:    status,
+		})
 	} else {
 		Error.Println("Could not change the status of WAF " + wafID + " to " + status)
 		Error.Println("We received the following status code: " + resp.Status() + " with response from the API: " + resp.String())
@@ -1050,7 +1426,16 @@ func changeStatus(apiEndpoint, apiKey, wafID, status string) {
 
 }
 
-func rulesConfig(apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig) {
+// rulesConfig sets the configured action on each rule and returns the rules that were updated
+func rulesConfig(apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig) []int64 {
+	var updated []int64
+
+	//snapshot rule statuses for the audit journal
+	var before map[string]string
+	if journal != nil {
+		before, _ = getRuleStatuses(apiEndpoint, apiKey, serviceID, wafID)
+	}
+
 	//implement individual rule management here
 	for _, rule := range config.Rules {
 
@@ -1076,17 +1461,42 @@ func rulesConfig(apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig
 		//check if our response was ok
 		if resp.Status() == "200 OK" {
 			Info.Printf("Rule %s was configured in the WAF with action %s\n", ruleID, config.Action)
+			recordRuleStatus(serviceID, wafID, ruleID, before[ruleID], config.Action)
+			updated = append(updated, rule)
 		} else {
 			Error.Printf("Could not set status: %s on rule tag: %s the response was: %s\n", config.Action, ruleID, resp.String())
 		}
 	}
+	return updated
+}
+
+// provisioningRules sets the log and block rules of the provisioning settings
+func provisioningRules(apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig) {
+	for _, set := range []struct {
+		Action string
+		Rules  []int64
+	}{{"log", config.Provisioning.LogRules}, {"block", config.Provisioning.BlockRules}} {
+		if len(set.Rules) == 0 {
+			continue
+		}
+		c := config
+		c.Action = set.Action
+		c.Rules = set.Rules
+		rulesConfig(apiEndpoint, apiKey, serviceID, wafID, c)
+	}
 }
 
 // DefaultRuleDisabled disables rule IDs defined in the configuration file
 func DefaultRuleDisabled(apiEndpoint, apiKey, serviceID, wafID string, config TOMLConfig) {
 
+	//snapshot rule statuses for the audit journal
+	var before map[string]string
+	if journal != nil {
+		before, _ = getRuleStatuses(apiEndpoint, apiKey, serviceID, wafID)
+	}
+
 	//implement individual rule management here
-	for _, rule := range config.DisabledRules {
+	for _, rule := range config.Provisioning.DisabledRules {
 
 		ruleID := strconv.FormatInt(rule, 10)
 
@@ -1110,6 +1520,7 @@ func DefaultRuleDisabled(apiEndpoint, apiKey, serviceID, wafID string, config TO
 		//check if our response was ok
 		if resp.Status() == "200 OK" {
 			Info.Printf("Rule %s was configured in the WAF with action disabled via disabledrules parameter\n", ruleID)
+			recordRuleStatus(serviceID, wafID, ruleID, before[ruleID], "disabled")
 		} else {
 			Error.Printf("Could not set status: %s on rule tag: %s the response was: %s\n", config.Action, ruleID, resp.String())
 		}
@@ -1152,7 +1563,7 @@ func AddLoggingCondition(client *fastly.Client, serviceID string, version int, c
 	cstmts = append(cstmts, weblogCondtion)
 	cn := "waf-soc-logging"
 
-	if withPX {
+	if withPX || config.Weblog.PerimeterX {
 		msgs = append(msgs, "PerimeterX")
 		cstmts = append(cstmts, "(req.http.x-request-id)")
 	}
@@ -1176,6 +1587,13 @@ func AddLoggingCondition(client *fastly.Client, serviceID string, version int, c
 				Error.Fatal(err)
 				return false
 			}
+			recordChange(JournalEntry{
+				ServiceID: serviceID,
+				Version:   version,
+				Resource:  "condition",
+				Name:      "waf-soc-logging-with-expiry",
+				Action:    "delete",
+			})
 		}
 	}
 
@@ -1194,6 +1612,21 @@ func AddLoggingCondition(client *fastly.Client, serviceID string, version int, c
 			Error.Fatal(err)
 			return false
 		}
+		var before string
+		for _, c := range conditions {
+			if strings.EqualFold(c.Name, cn) {
+				before = c.Statement
+			}
+		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "condition",
+			Name:      cn,
+			Action:    "update",
+			Before:    before,
+			After:     strings.Join(cstmts, " && "),
+		})
 	} else {
 		Info.Printf("Creating WAF logging condition : %q\n", cn)
 		_, err = client.CreateCondition(&fastly.CreateConditionInput{
@@ -1208,6 +1641,14 @@ func AddLoggingCondition(client *fastly.Client, serviceID string, version int, c
 			Error.Fatal(err)
 			return false
 		}
+		recordChange(JournalEntry{
+			ServiceID: serviceID,
+			Version:   version,
+			Resource:  "condition",
+			Name:      cn,
+			Action:    "create",
+			After:     strings.Join(cstmts, " && "),
+		})
 	}
 
 	// Assign the conditions to the WAF web-log object
@@ -1222,6 +1663,14 @@ func AddLoggingCondition(client *fastly.Client, serviceID string, version int, c
 		Error.Fatal(err)
 		return false
 	}
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		Version:   version,
+		Resource:  "syslog",
+		Name:      config.Weblog.Name,
+		Action:    "update",
+		After:     map[string]string{"response_condition": cn},
+	})
 
 	return true
 
@@ -1238,6 +1687,13 @@ func PatchRules(serviceID, wafID string, client *fastly.Client, apiKey string) b
 		Error.Print(err)
 		return false
 	}
+	recordChange(JournalEntry{
+		ServiceID: serviceID,
+		WAFID:     wafID,
+		Resource:  "ruleset",
+		Name:      wafID,
+		Action:    "patch",
+	})
 
 	Info.Println("Checking for deployment status")
 	for {
@@ -1265,8 +1721,9 @@ func PatchRules(serviceID, wafID string, client *fastly.Client, apiKey string) b
 	return true
 }
 
-// changeConfigurationSet function allows you to change a config set for a WAF object
-func setConfigurationSet(wafID, configurationSet string, client *fastly.Client) bool {
+// changeConfigurationSet function allows you to change a config set for a WAF object, previous is the
+// configuration set before the change for the audit journal
+func setConfigurationSet(wafID, previous, configurationSet string, client *fastly.Client) bool {
 
 	wafs := []fastly.ConfigSetWAFs{{ID: wafID}}
 
@@ -1280,6 +1737,14 @@ func setConfigurationSet(wafID, configurationSet string, client *fastly.Client)
 		Error.Println("Error setting configuration set ID: " + configurationSet)
 		return false
 	}
+	recordChange(JournalEntry{
+		WAFID:    wafID,
+		Resource: "configuration_set",
+		Name:     wafID,
+		Action:   "update",
+		Before:   previous,
+		After:    configurationSet,
+	})
 
 	return true
 
@@ -1693,15 +2158,9 @@ func getAllRules(apiEndpoint, apiKey, configID string) bool {
 
 }
 
-// backupConfig function stores all rules, status, configuration set, and OWASP configuration locally
-func backupConfig(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.Client, bpath string) bool {
-
-	//validate the output path
-	d := filepath.Dir(bpath)
-	if _, err := os.Stat(d); os.IsNotExist(err) {
-		Error.Printf("Output path does not exist: %s\n", d)
-		return false
-	}
+// collectBackup gathers the rule statuses and OWASP settings of a WAF
+func collectBackup(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.Client) (Backup, bool) {
+	backup := Backup{}
 
 	//get all rules and their status
 	//set our API call
@@ -1717,7 +2176,7 @@ func backupConfig(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.C
 	if err != nil {
 		Error.Println("Error with API call: " + apiCall)
 		Error.Println(resp.String())
-		return false
+		return backup, false
 	}
 
 	//unmarshal the response and extract the service id
@@ -1726,7 +2185,7 @@ func backupConfig(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.C
 
 	if len(body.Data) == 0 {
 		Error.Println("No rules found to back up")
-		return false
+		return backup, false
 	}
 
 	result := PagesOfRules{[]RuleList{}}
@@ -1755,7 +2214,7 @@ func backupConfig(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.C
 		if err != nil {
 			Error.Println("Error with API call: " + apiCall)
 			Error.Println(resp.String())
-			return false
+			return backup, false
 		}
 
 		//unmarshal the response and extract the service id
@@ -1798,38 +2257,10 @@ func backupConfig(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.C
 
 	if owasp.ID == "" {
 		Error.Println("No OWASP Object to back up")
-		return false
+		return backup, false
 	}
 
-	o := owaspSettings{
-		AllowedHTTPVersions:              owasp.AllowedHTTPVersions,
-		AllowedMethods:                   owasp.AllowedMethods,
-		AllowedRequestContentType:        owasp.AllowedRequestContentType,
-		AllowedRequestContentTypeCharset: owasp.AllowedRequestContentTypeCharset,
-		ArgLength:                        owasp.ArgLength,
-		ArgNameLength:                    owasp.ArgNameLength,
-		CombinedFileSizes:                owasp.CombinedFileSizes,
-		CriticalAnomalyScore:             owasp.CriticalAnomalyScore,
-		CRSValidateUTF8Encoding:          owasp.CRSValidateUTF8Encoding,
-		ErrorAnomalyScore:                owasp.ErrorAnomalyScore,
-		HTTPViolationScoreThreshold:      owasp.HTTPViolationScoreThreshold,
-		InboundAnomalyScoreThreshold:     owasp.InboundAnomalyScoreThreshold,
-		LFIScoreThreshold:                owasp.LFIScoreThreshold,
-		MaxFileSize:                      owasp.MaxFileSize,
-		MaxNumArgs:                       owasp.MaxNumArgs,
-		NoticeAnomalyScore:               owasp.NoticeAnomalyScore,
-		ParanoiaLevel:                    owasp.ParanoiaLevel,
-		PHPInjectionScoreThreshold:       owasp.PHPInjectionScoreThreshold,
-		RCEScoreThreshold:                owasp.RCEScoreThreshold,
-		RestrictedExtensions:             owasp.RestrictedExtensions,
-		RestrictedHeaders:                owasp.RestrictedHeaders,
-		RFIScoreThreshold:                owasp.RFIScoreThreshold,
-		SessionFixationScoreThreshold:    owasp.SessionFixationScoreThreshold,
-		SQLInjectionScoreThreshold:       owasp.SQLInjectionScoreThreshold,
-		XSSScoreThreshold:                owasp.XSSScoreThreshold,
-		TotalArgLength:                   owasp.TotalArgLength,
-		WarningAnomalyScore:              owasp.WarningAnomalyScore,
-	}
+	o := owaspFromFastly(owasp)
 
 	//create a hash
 	hasher := sha1.New()
@@ -1837,7 +2268,7 @@ func backupConfig(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.C
 	sha := hex.EncodeToString(hasher.Sum(nil))
 
 	//Safe Backup Object
-	backup := Backup{
+	backup = Backup{
 		ID:        sha,
 		ServiceID: serviceID,
 		Disabled:  disabled,
@@ -1847,22 +2278,55 @@ func backupConfig(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.C
 		Updated:   time.Now(),
 	}
 
-	buf := new(bytes.Buffer)
-	if err := toml.NewEncoder(buf).Encode(backup); err != nil {
+	return backup, true
+}
+
+// backupConfig function stores all rules, status, configuration set, and OWASP configuration locally
+func backupConfig(apiEndpoint, apiKey, serviceID, wafID string, client *fastly.Client, bpath string) bool {
+
+	//validate the output path
+	d := filepath.Dir(bpath)
+	if _, err := os.Stat(d); os.IsNotExist(err) {
+		Error.Printf("Output path does not exist: %s\n", d)
+		return false
+	}
+
+	backup, ok := collectBackup(apiEndpoint, apiKey, serviceID, wafID, client)
+	if !ok {
+		return false
+	}
+
+	//TOML, YAML or JSON by the extension of the path
+	doc, err := encodeDocument(bpath, backup)
+	if err != nil {
 		Error.Println(err)
 		return false
 	}
 
-	err = ioutil.WriteFile(bpath, buf.Bytes(), 0644)
+	err = ioutil.WriteFile(bpath, doc, 0644)
 	if err != nil {
 		Error.Println(err)
 		return false
 	}
 
-	Info.Printf("Bytes written: %d to %s\n", buf.Len(), bpath)
+	Info.Printf("Bytes written: %d to %s\n", len(doc), bpath)
 	return true
 }
 
+// wafFilePath fills the <service-id> and <waf-id> placeholders of a local file path. When several WAF
+// objects are processed and the path has no <waf-id>, the WAF ID is added before the extension.
+func wafFilePath(fpath, serviceID, wafID string, multiple bool) string {
+	fpath = strings.Replace(fpath, "<service-id>", serviceID, -1)
+	if strings.Contains(fpath, "<waf-id>") {
+		return strings.Replace(fpath, "<waf-id>", wafID, -1)
+	}
+	if multiple {
+		ext := filepath.Ext(fpath)
+		return strings.TrimSuffix(fpath, ext) + "-" + wafID + ext
+	}
+	return fpath
+}
+
 func homeDir() string {
 	user, err := user.Current()
 	if err != nil {
@@ -1874,29 +2338,95 @@ func homeDir() string {
 var (
 	app              = kingpin.New("waflyctl", "Fastly WAF Control Tool").Version(version)
 	action           = app.Flag("action", "Action to take on the rules list and rule tags. Overwrites action defined in config file. One of: disabled, block, log.").Enum("disabled", "block", "log")
-	apiEndpoint      = app.Flag("apiendpoint", "Fastly API endpoint to use.").Default("https://api.fastly.com").String()
-	apiKey           = app.Flag("apikey", "API Key to use.").Envar("FASTLY_API_TOKEN").Required().String()
+	alertBlocked     = app.Flag("alert-blocked", "Alert during --watch when WAF blocked requests per second go above this value.").Float64()
+	alertLogged      = app.Flag("alert-logged", "Alert during --watch when WAF logged requests per second go above this value.").Float64()
+	allWAFs          = app.Flag("all-wafs", "Apply the operation to every WAF object on the service.").Bool()
+	apiEndpoint      = app.Flag("apiendpoint", "Fastly API endpoint to use. Defaults to the endpoint of the profile or "+defaultAPIEndpoint+".").String()
+	apiKey           = app.Flag("apikey", "API Key to use. Prefer FASTLY_API_TOKEN, --token-helper, --token-file or the OS keyring, which keep it out of shell history. Defaults to the API key of the profile.").Envar("FASTLY_API_TOKEN").String()
 	backup           = app.Flag("backup", "Store a copy of the WAF configuration locally.").Bool()
-	backupPath       = app.Flag("backup-path", "Location for the WAF configuration backup file.").Default(homeDir() + "/waflyctl-backup-<service-id>.toml").String()
-	configFile       = app.Flag("config", "Location of configuration file for waflyctl.").Default(homeDir() + "/.waflyctl.toml").String()
+	backupPath       = app.Flag("backup-path", "Location for the WAF configuration backup file. Written as YAML or JSON for a .yaml, .yml or .json extension.").Default(homeDir() + "/waflyctl-backup-<service-id>.toml").String()
+	policyPath       = app.Flag("check", "Check the live WAF against the assertions of a policy file. Exits nonzero when one fails.").PlaceHolder("POLICY").String()
+	checkFormat      = app.Flag("check-format", "Format of the --check-report. One of: junit, json.").Default("junit").Enum("junit", "json")
+	checkReportPath  = app.Flag("check-report", "Location for the --check report file.").String()
+	compare          = app.Flag("compare", "Compare the WAF setup of --serviceid with these services in a comma delimited fashion, listing every setting that differs.").PlaceHolder("SERVICE-IDS").String()
+	compareFormat    = app.Flag("compare-format", "Output of --compare. One of: table, json, markdown.").Default("table").Enum("table", "json", "markdown")
+	configFile       = app.Flag("config", "Location of configuration file for waflyctl. Read as YAML or JSON for a .yaml, .yml or .json extension.").Default(homeDir() + "/.waflyctl.toml").String()
+	convertCfg       = app.Flag("convert-config", "Write --config to this file in the format of its extension: .toml, .yaml, .yml or .json.").PlaceHolder("FILE").String()
 	configurationSet = app.Flag("configuration-set", "Changes WAF configuration set to the provided one.").String()
+	copyFrom         = app.Flag("copy-from", "Copy the WAF setup of this service to the --serviceid one, provisioning the WAF if needed. Shows the changes and asks for confirmation first.").PlaceHolder("SERVICE-ID").String()
+	copyFromWAF      = app.Flag("copy-from-waf", "WAF object to copy when the --copy-from service has more than one.").String()
 	deprovision      = app.Flag("delete", "Remove a WAF configuration created with waflyctl.").Bool()
 	deleteLogs       = app.Flag("delete-logs", "When set removes WAF logging configuration.").Bool()
+	diff             = app.Flag("diff", "Show the WAF related changes between the active version and --service-version (latest by default).").Bool()
+	diffAll          = app.Flag("diff-all", "Do not filter --diff to WAF related objects.").Bool()
+	exportCfg        = app.Flag("export-config", "Write a config file that reproduces the WAF setup of the service with --provision.").Bool()
+	exportPath       = app.Flag("export-path", "Location for the config file written by --export-config. Written as YAML or JSON for a .yaml, .yml or .json extension.").Default(homeDir() + "/waflyctl-<service-id>.toml").String()
+	exportTF         = app.Flag("export-terraform", "Write the WAF setup of the service as Terraform HCL and list the matching terraform import commands.").Bool()
 	forceStatus      = app.Flag("force-status", "Force all rules (inc. disabled) to update for the given tag.").Bool()
 	logOnly          = app.Flag("enable-logs-only", "Add logging configuration only to the service. No other changes will be made. Can be used together with --with-perimeterx").Bool()
 	omitLogs         = app.Flag("no-logs", "Provision the WAF without setting up any logging endpoints.").Bool()
+	noValidate       = app.Flag("no-validate", "Do not validate the version at the end of a versioned operation. Use it for all but the last of several operations stacked on one --service-version.").Bool()
+	guardSamples     = app.Flag("guard-baseline-samples", "Number of stats samples, taken --watch-interval apart, averaged into the WAF blocked baseline of --guard-window.").Default("5").Int()
+	guardMinRate     = app.Flag("guard-min-rate", "Lowest WAF blocked requests per second that can trigger a revert during --guard-window.").Default("1").Float64()
+	guardMultiple    = app.Flag("guard-multiple", "Revert during --guard-window when WAF blocks exceed this multiple of the baseline.").Default("3").Float64()
+	guardWindow      = app.Flag("guard-window", "After switching rules to block, watch WAF blocks for this long and restore the previous rule statuses if they spike. Example: 15m.").Duration()
+	history          = app.Flag("history", "List changes recorded in the audit journal for the service. Filter with --history-rule, --history-since and --history-until.").Bool()
+	historyRule      = app.Flag("history-rule", "Only list audit journal changes to this rule ID.").String()
+	historySince     = app.Flag("history-since", "Only list audit journal changes on or after this date (YYYY-MM-DD).").String()
+	historyUntil     = app.Flag("history-until", "Only list audit journal changes on or before this date (YYYY-MM-DD).").String()
+	initCfg          = app.Flag("init", "Ask about the application stack, logging, paranoia level, block page and rollout mode and write a starter config to --config.").Bool()
+	journalPath      = app.Flag("journal-path", "Location of the audit journal recording every change. Set it empty to turn the journal off.").Default(homeDir() + "/waflyctl-journal.jsonl").String()
 	listAllRules     = app.Flag("list-all-rules", "List all rules available on the Fastly platform for a given configuration set.").PlaceHolder("CONFIGURATION-SET").String()
 	listConfigSet    = app.Flag("list-configuration-sets", "List all configuration sets and their status.").Bool()
 	listRules        = app.Flag("list-rules", "List current WAF rules and their status.").Bool()
+	listWAFsFlag     = app.Flag("list-wafs", "List the WAF objects of the service with their prefetch condition, response, configuration set and last push.").Bool()
+	migrateCfg       = app.Flag("migrate-config", "Upgrade --config and the files it includes to the current schema version, keeping the old files with a .bak suffix.").Bool()
+	overlays         = app.Flag("overlay", "Config file merged on top of --config, for an environment or a service. Repeat it to stack overlays. <service-id> in the path is replaced by --serviceid and such an overlay is optional.").Strings()
 	editOWASP        = app.Flag("owasp", "Edit the OWASP object base on the settings in the configuration file.").Bool()
+	owaspAdd         = app.Flag("owasp-add", "Add values to an OWASP list setting and update only that setting. Repeat it for more settings. Example: --owasp-add RestrictedExtensions=.config,.env").PlaceHolder("SETTING=VALUES").Strings()
+	owaspRemove      = app.Flag("owasp-remove", "Remove values from an OWASP list setting and update only that setting. Repeat it for more settings. Example: --owasp-remove AllowedMethods=DELETE").PlaceHolder("SETTING=VALUES").Strings()
+	planPromotion    = app.Flag("plan-promotion", "Put the rules from the config file or --rules in log mode and track them in the promotion plan.").Bool()
+	promote          = app.Flag("promote", "Move rules in the promotion plan that completed their soak period to block mode.").Bool()
+	promotionPath    = app.Flag("promotion-plan", "Location for the rule promotion plan file.").Default(homeDir() + "/waflyctl-promotion-<service-id>.toml").String()
+	promoteThreshold = app.Flag("promote-threshold", "Hold back rules with more hits than this in the WAF logs given with --waf-logs.").Default("0").Int()
+	profileName      = app.Flag("profile", "Profile of the profiles file to take the API key, endpoint and service aliases from. Defaults to the default profile of the file.").Envar("WAFLYCTL_PROFILE").String()
+	profilesPath     = app.Flag("profiles", "Location of the profiles file.").Default(homeDir() + "/.waflyctl/profiles.toml").String()
 	provision        = app.Flag("provision", "Provision a new WAF or update an existing one.").Bool()
+	prune            = app.Flag("prune-versions", "Lock abandoned draft versions newer than the active one that were created by waflyctl, showing their WAF related changes first.").Bool()
+	pruneDryRun      = app.Flag("prune-dry-run", "Only show what --prune-versions would do.").Bool()
+	pruneKeep        = app.Flag("prune-keep", "Number of newest abandoned drafts --prune-versions leaves alone.").Default("1").Int()
+	pruneMatch       = app.Flag("prune-match", "Regular expression a version comment must match to be pruned. The default matches only the comments waflyctl sets on the versions it clones.").Default("^(Created by waflyctl|waflyctl undo of run )").String()
+	pruneOlderThan   = app.Flag("prune-older-than", "Only prune drafts that have not changed for this long. Example: 168h.").Duration()
 	publishers       = app.Flag("publisher", "Which rule publisher to use in a comma delimited fashion. Overwrites publisher defined in config file. Choices are: owasp, trustwave, fastly").String()
+	renderCfg        = app.Flag("render-config", "Print the effective config merged from --config, its includes, the overlays and the command line, with where each value comes from.").Bool()
+	report           = app.Flag("report", "Write a WAF posture report of the service for auditors.").Bool()
+	reportFormat     = app.Flag("report-format", "Format of the --report. One of: html, markdown.").Default("html").Enum("html", "markdown")
+	reportPath       = app.Flag("report-path", "Location for the --report file.").Default(homeDir() + "/waflyctl-report-<service-id>.html").String()
 	rules            = app.Flag("rules", "Which rules to apply action on in a comma delimited fashion. Overwrites ruleid defined in config file. Example: 1010010,931100,931110.").String()
-	serviceID        = app.Flag("serviceid", "Service ID to Provision.").Required().String()
+	rtEndpoint       = app.Flag("rt-endpoint", "Fastly realtime stats endpoint to use.").Default("https://rt.fastly.com").String()
+	runID            = app.Flag("run-id", "Run to reverse with --undo. Defaults to the last journaled run on the service.").String()
+	saveToken        = app.Flag("save-token", "Save the API key to the OS keyring under the profile name, or default without a profile.").Bool()
+	serviceVersion   = app.Flag("service-version", "Service version to edit instead of a clone of the active version. A version number or latest. Locked and active versions are cloned first.").PlaceHolder("VERSION").String()
+	serviceID        = app.Flag("serviceid", "Service ID to Provision. Also takes a service alias of the profile or a service name.").String()
+	setOWASP         = app.Flag("set", "Override an OWASP setting of the config, or its preset with preset=NAME. Repeat it for more settings. Example: --set ParanoiaLevel=2").PlaceHolder("KEY=VALUE").Strings()
+	soakDays         = app.Flag("soak-days", "How many days rules added with --plan-promotion stay in log mode before they can be promoted.").Default("14").Int()
 	status           = app.Flag("status", "Disable or Enable the WAF. A disabled WAF will not block any traffic. In addition disabling a WAF does not change rule statuses on its configure policy. One of: disable, enable.").Enum("disable", "enable")
 	tags             = app.Flag("tags", "Which rules tags to add to the ruleset in a comma delimited fashion. Overwrites tags defined in config file. Example: wordpress,language-php,drupal.").String()
+	terraformPath    = app.Flag("terraform-path", "Location for the Terraform file written by --export-terraform.").Default(homeDir() + "/waflyctl-<service-id>.tf").String()
+	tokenFile        = app.Flag("token-file", "Read the API key from this file. It must not be accessible by other users.").String()
+	tokenHelper      = app.Flag("token-helper", "Get the API key from this credential helper command, which receives protocol and host on stdin like a git credential helper and prints password=<token>.").PlaceHolder("COMMAND").String()
+	tokenKeyring     = app.Flag("token-keyring", "Read the API key from the OS keyring, the macOS keychain or the Secret Service on Linux.").Bool()
+	undo             = app.Flag("undo", "Reverse the changes of a previous run recorded in the audit journal.").Bool()
+	validateCfg      = app.Flag("validate-config", "Check the effective config for unknown keys, invalid values, OWASP list syntax and ranges, TLS certificates and VCL condition syntax. --provision runs the same checks.").Bool()
+	wafID            = app.Flag("waf-id", "WAF object to work on when the service has more than one.").String()
+	wafLogs          = app.Flag("waf-logs", "WAF log files in a comma delimited fashion used to hold back noisy rules during --promote.").String()
+	watch            = app.Flag("watch", "Display live WAF logged, blocked and passed rates for the service.").Bool()
+	watchCount       = app.Flag("watch-count", "Stop --watch after this many updates. Runs until interrupted by default.").Int()
+	watchInterval    = app.Flag("watch-interval", "Time between stats updates during --watch and --guard-window.").Default("5s").Duration()
+	watchSource      = app.Flag("watch-source", "Stats used by --watch and --guard-window. One of: realtime, minutely.").Default("realtime").Enum("realtime", "minutely")
 	weblogExpiry     = app.Flag("web-log-expiry", "The default expiry of the web-log condition, expressed in days from the current date-time.").Default("-1").Int()
 	withPX           = app.Flag("with-perimeterx", "Enable if the customer has PerimeterX enabled on the service as well as WAF. Helps fix null value logging.").Bool()
+	assumeYes        = app.Flag("yes", "Do not ask for confirmation.").Bool()
 	addComment       = app.Flag("comment", "Add version comment when creating a new version.").String()
 )
 
@@ -1921,14 +2451,100 @@ func main() {
 
 	fmt.Println("Fastly WAF Control Tool version: " + version + " built on " + date)
 
+	//write a starter config
+	if *initCfg {
+		if !initWizard(*configFile) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	//translate the config file to another format
+	if *convertCfg != "" {
+		if !convertConfig(*configFile, *convertCfg) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	//upgrade an older config file to the current schema
+	if *migrateCfg {
+		if !migrateConfig(*configFile, make(map[string]bool)) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	//settings given on the command line go on top of the config files
+	cli := make(map[string]interface{})
+	if *action != "" {
+		cli["Action"] = *action
+	}
+	if *rules != "" {
+		var ids []interface{}
+		for _, id := range strings.Split(*rules, ",") {
+			//cast IDs from string to int
+			i, _ := strconv.ParseInt(id, 10, 32)
+			ids = append(ids, i)
+		}
+		cli["Rules"] = ids
+	}
+	if *tags != "" {
+		var names []interface{}
+		for _, tag := range strings.Split(*tags, ",") {
+			names = append(names, tag)
+		}
+		cli["Tags"] = names
+	}
+	if *publishers != "" {
+		var names []interface{}
+		for _, publisher := range strings.Split(*publishers, ",") {
+			names = append(names, publisher)
+		}
+		cli["Publisher"] = names
+	}
+	if *weblogExpiry >= 0 {
+		cli["Weblog"] = map[string]interface{}{"Expiry": int64(*weblogExpiry)}
+	}
+	if len(*setOWASP) > 0 {
+		owasp, err := owaspOverrides(*setOWASP)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cli["Owasp"] = owasp
+	}
+
 	//run init to get our logging configured
-	config := Init(*configFile)
+	config, layered := Init(*configFile, *overlays, *serviceID, cli)
+	owaspKeys := owaspFields(layered)
+	listEdits, err := owaspListEdits(*owaspAdd, *owaspRemove)
+	if err != nil {
+		Error.Println(err)
+		os.Exit(1)
+	}
 
+	//print the effective config
+	if *renderCfg {
+		renderConfig(layered)
+		os.Exit(0)
+	}
+
+	//fill the API key and endpoint from the profile unless given on the command line
+	profile, ok := loadProfile(*profilesPath, *profileName)
+	if !ok {
+		os.Exit(1)
+	}
+	if *apiEndpoint == "" {
+		*apiEndpoint = profile.APIEndpoint
+	}
+	if *apiEndpoint == "" {
+		*apiEndpoint = defaultAPIEndpoint
+	}
 	config.APIEndpoint = *apiEndpoint
 
 	//check if rule action was set on CLI
 	if *action != "" {
-		config.Action = *action
 		Info.Println("using rule action set by CLI: ", *action)
 	}
 
@@ -1937,43 +2553,83 @@ func main() {
 		Info.Println("using rule status set by CLI: ", *status)
 	}
 
-	//if rules are passed via CLI parse them and replace config parameters
+	//rules passed via CLI replace the config parameters
 	if *rules != "" {
 		Info.Println("using rule IDS set by CLI:")
-		ruleIDs := strings.Split(*rules, ",")
-		for _, id := range ruleIDs {
-			//cast IDs from string to int
-			i, _ := strconv.ParseInt(id, 10, 32)
+		for _, id := range config.Rules {
 			Info.Println("- ruleID:", id)
-			config.Rules = append(config.Rules, i)
-
 		}
 	}
 
-	//if rule tags are passed via CLI parse them and replace config parameters
+	//rule tags passed via CLI replace the config parameters
 	if *tags != "" {
 		Info.Println("using tags set by CLI:")
-		tags := strings.Split(*tags, ",")
-		for _, tag := range tags {
+		for _, tag := range config.Tags {
 			Info.Println(" - tag name: ", tag)
-			config.Tags = append(config.Tags, tag)
 		}
 	}
 
-	//if rule publisher is passed via CLI parse them and replace config parameters
+	//rule publishers passed via CLI replace the config parameters
 	if *publishers != "" {
 		Info.Println("using publisher set by CLI:")
-		publishers := strings.Split(*publishers, ",")
-		for _, publisher := range publishers {
+		for _, publisher := range config.Publisher {
 			Info.Println(" - publisher name: ", publisher)
-			config.Publisher = append(config.Publisher, publisher)
 		}
 	}
 
-	//if log expiry is passed through CLI, override config file
+	//log expiry passed through CLI overrides the config file
 	if *weblogExpiry >= 0 {
 		Info.Println("using web log expiry set by CLI:", *weblogExpiry)
-		config.Weblog.Expiry = uint(*weblogExpiry)
+	}
+
+	//check the config before it is used to provision
+	if *validateCfg || *provision {
+		Info.Println("Validating config")
+		valid := reportConfigProblems(validateConfig(config, layered))
+		if *validateCfg {
+			if !valid {
+				os.Exit(1)
+			}
+			Info.Println("Completed")
+			os.Exit(0)
+		}
+		if !valid {
+			Error.Println("Fix the config errors above before provisioning")
+			os.Exit(1)
+		}
+	}
+
+	// list changes from the audit journal
+	if *history {
+		Info.Println("Listing audit journal entries")
+		if !showHistory(*journalPath, resolveAlias(profile, *serviceID), *historyRule, *historySince, *historyUntil) {
+			os.Exit(1)
+		}
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
+	//find the API key
+	if apiKeyOnCommandLine(os.Args[1:]) {
+		Warning.Println("API key given on the command line shows up in shell history and process listings, use FASTLY_API_TOKEN, --token-helper, --token-file or --token-keyring instead")
+	}
+	if *apiKey == "" {
+		*apiKey, ok = resolveAPIKey(profile, *tokenHelper, *tokenFile, *tokenKeyring, config.APIEndpoint)
+		if !ok {
+			os.Exit(1)
+		}
+	}
+	if *apiKey == "" {
+		Error.Fatal("No API key given, use FASTLY_API_TOKEN, --token-helper, --token-file, --token-keyring or a --profile with an API key")
+	}
+
+	//store the API key in the OS keyring
+	if *saveToken {
+		if !saveAPIKey(profile, *apiKey) {
+			os.Exit(1)
+		}
+		Info.Println("Completed")
+		os.Exit(0)
 	}
 
 	//create Fastly client
@@ -1982,15 +2638,156 @@ func main() {
 		Error.Fatal(err)
 	}
 
+	//list configuration sets rules
+	if *listConfigSet {
+		Info.Println("Listing all configuration sets")
+		getConfigurationSets(config.APIEndpoint, *apiKey)
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
+	//list all rules for a given configset
+	if *listAllRules != "" {
+		Info.Printf("Listing all rules under configuration set ID: %s\n", *listAllRules)
+		configID := *listAllRules
+		getAllRules(config.APIEndpoint, *apiKey, configID)
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
+	//every other operation works on a service
+	*serviceID = resolveService(client, profile, *serviceID)
+	if *serviceID == "" {
+		Error.Fatal("No service given, use --serviceid with a service ID, a service alias of the profile or a service name")
+	}
+	if *copyFrom != "" {
+		*copyFrom = resolveService(client, profile, *copyFrom)
+	}
+
+	compared := []string{*serviceID}
+	for _, s := range strings.Split(*compare, ",") {
+		if s = resolveService(client, profile, s); s != "" && s != *serviceID {
+			compared = append(compared, s)
+		}
+	}
+
+	//make sure the token and user may do what was asked before changing anything
+	ops := []operation{
+		{"--watch", false, *watch},
+		{"--undo", true, *undo},
+		{"--diff", false, *diff},
+		{"--prune-versions", !*pruneDryRun, *prune},
+		{"--compare", false, *compare != ""},
+		{"--copy-from", true, *copyFrom != ""},
+		{"--enable-logs-only", true, *logOnly},
+		{"--delete", true, *deprovision},
+		{"--delete-logs", true, *deleteLogs},
+		{"--list-wafs", false, *listWAFsFlag},
+		{"--list-rules", false, *listRules},
+		{"--configuration-set", true, *configurationSet != ""},
+		{"--status", true, *status != ""},
+		{"--plan-promotion", true, *planPromotion},
+		{"--promote", true, *promote},
+		{"--tags", true, *tags != ""},
+		{"--publisher", true, *publishers != ""},
+		{"--rules", true, *rules != ""},
+		{"--owasp", true, *editOWASP},
+		{"--owasp-add/--owasp-remove", true, len(listEdits) > 0},
+		{"--with-perimeterx", true, *withPX},
+		{"--backup", false, *backup},
+		{"--report", false, *report},
+		{"--check", false, *policyPath != ""},
+		{"--export-config", false, *exportCfg},
+		{"--export-terraform", false, *exportTF},
+		{"--provision", true, *provision},
+	}
+	services := append([]string{}, compared...)
+	if *copyFrom != "" {
+		services = append(services, *copyFrom)
+	}
+	if !preflight(client, ops, services) {
+		os.Exit(1)
+	}
+
+	//record every change of this run in the audit journal
+	if *journalPath != "" {
+		openJournal(*journalPath, *serviceID, client)
+	}
+
+	// follow WAF traffic on the service
+	if *watch {
+		sample, ok := newWAFTrafficSampler(client, *apiKey, *serviceID, *watchSource, *rtEndpoint)
+		if !ok || !watchWAF(sample, *serviceID, *watchSource, *watchInterval, *alertBlocked, *alertLogged, *watchCount) {
+			os.Exit(1)
+		}
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
 	//get currently activeVersion to be used
 	activeVersion := getActiveVersion(client, *serviceID)
 
+	// reverse a previous run
+	if *undo {
+		if !undoRun(client, config.APIEndpoint, *apiKey, *serviceID, *runID, *journalPath, config, activeVersion) {
+			Error.Println("Undo did not complete cleanly..see above for details")
+			os.Exit(1)
+		}
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
+	// review the changes of a version before activating it
+	if *diff {
+		requested := *serviceVersion
+		if requested == "" {
+			requested = "latest"
+		}
+		target := getVersion(client, *serviceID, requested).Number
+		if target == activeVersion {
+			Warning.Printf("Version %d is the active version, nothing to compare\n", target)
+		} else if !showVersionDiff(client, *serviceID, activeVersion, target, config, *diffAll) {
+			os.Exit(1)
+		}
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
+	// clean up drafts left behind by failed runs
+	if *prune {
+		Info.Println("Pruning abandoned draft versions")
+		if !pruneVersions(client, *serviceID, activeVersion, config, *pruneMatch, *pruneKeep, *pruneOlderThan, *pruneDryRun) {
+			os.Exit(1)
+		}
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
+	// compare the WAF setup with other services
+	if *compare != "" {
+		if !compareServices(client, config.APIEndpoint, *apiKey, compared, *compareFormat) {
+			os.Exit(1)
+		}
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
+	// copy the WAF setup of another service
+	if *copyFrom != "" {
+		Info.Printf("Copying WAF configuration from Service ID %s\n", *copyFrom)
+		if !copyWAF(client, config, *apiKey, *copyFrom, *copyFromWAF, *serviceID, *wafID, activeVersion, *serviceVersion, *addComment, *omitLogs, *withPX, *assumeYes) {
+			os.Exit(1)
+		}
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
 	// add logs only to a service
 	if *logOnly {
 
 		Info.Println("Adding logging endpoints only")
 
-		version := cloneVersion(client, *serviceID, activeVersion, *addComment)
+		version := draftVersion(client, *serviceID, activeVersion, *serviceVersion, *addComment)
 
 		//create VCL Snippet
 		vclSnippet(client, *serviceID, config.Vclsnippet, version)
@@ -2002,16 +2799,16 @@ func main() {
 		AddLoggingCondition(client, *serviceID, version, config, *withPX)
 
 		//validate the config
-		validateVersion(client, *serviceID, version)
+		finishVersion(client, *serviceID, activeVersion, version, config)
 		Info.Println("Completed")
 		os.Exit(0)
 
 	}
 	// check if is a de-provisioning call
 	if *deprovision {
-		version := cloneVersion(client, *serviceID, activeVersion, *addComment)
+		version := draftVersion(client, *serviceID, activeVersion, *serviceVersion, *addComment)
 
-		result := DeprovisionWAF(client, *serviceID, *apiKey, config, version)
+		result := DeprovisionWAF(client, *serviceID, *apiKey, config, version, *wafID, *allWAFs)
 		if result {
 			Info.Printf("Successfully deleted WAF on Service ID %s. Do not forget to activate version %v!\n", *serviceID, version)
 			Info.Println("Completed")
@@ -2025,7 +2822,7 @@ func main() {
 
 	// check if is a delete logs parameter was called
 	if *deleteLogs {
-		version := cloneVersion(client, *serviceID, activeVersion, *addComment)
+		version := draftVersion(client, *serviceID, activeVersion, *serviceVersion, *addComment)
 
 		//delete the logs
 		result := DeleteLogsCall(client, *serviceID, config, version)
@@ -2042,65 +2839,113 @@ func main() {
 	}
 
 	Info.Printf("Active config version: %v.\n", activeVersion)
+
+	//WAF objects are looked up on the requested version when one is given
+	baseVersion := activeVersion
+	if *serviceVersion != "" {
+		baseVersion = getVersion(client, *serviceID, *serviceVersion).Number
+		Info.Printf("Working from config version: %v.\n", baseVersion)
+	}
+
 	wafs, err := client.ListWAFs(&fastly.ListWAFsInput{
 		Service: *serviceID,
-		Version: activeVersion,
+		Version: baseVersion,
 	})
 
 	if err != nil {
 		Error.Fatal(err)
 	}
 
+	switch {
+
+	//list waf objects
+	case *listWAFsFlag:
+		Info.Printf("Listing all WAF objects on version %v\n", baseVersion)
+		listWAFs(wafs)
+		Info.Println("Completed")
+		os.Exit(0)
+	}
+
 	if len(wafs) != 0 {
 
+		//pick the WAF objects to work on
+		selected, ok := selectWAFs(wafs, *wafID, *allWAFs)
+		if !ok {
+			os.Exit(1)
+		}
+
+		//policy checks report every WAF before failing the run
+		failed := false
+
 		//do rule adjustment here
-		for index, waf := range wafs {
+		for index, waf := range selected {
+
+			if len(selected) > 1 {
+				Info.Printf("Working on WAF #%v ID: %s\n", index+1, waf.ID)
+			}
 
 			//if no individual tags or rules are set via CLI run both actions
 			switch {
 
-			//list configuration sets rules
-			case *listConfigSet:
-				Info.Println("Listing all configuration sets")
-				getConfigurationSets(config.APIEndpoint, *apiKey)
-				Info.Println("Completed")
-				os.Exit(0)
-
 			//list waf rules
 			case *listRules:
 				Info.Printf("Listing all rules for WAF ID: %s\n", waf.ID)
 				getRules(config.APIEndpoint, *apiKey, *serviceID, waf.ID)
-				Info.Println("Completed")
-				os.Exit(0)
-
-			//list all rules for a given configset
-			case *listAllRules != "":
-				Info.Printf("Listing all rules under configuration set ID: %s\n", *listAllRules)
-				configID := *listAllRules
-				getAllRules(config.APIEndpoint, *apiKey, configID)
-				Info.Println("Completed")
-				os.Exit(0)
 
 			//change a configuration set
 			case *configurationSet != "":
 				Info.Printf("Changing Configuration Set to: %s\n", *configurationSet)
 				configID := *configurationSet
-				setConfigurationSet(waf.ID, configID, client)
-				Info.Println("Completed")
-				os.Exit(0)
+				var previous string
+				if waf.ConfigurationSet != nil {
+					previous = waf.ConfigurationSet.ID
+				}
+				setConfigurationSet(waf.ID, previous, configID, client)
 
 			case *status != "":
 				Info.Println("Changing WAF Status")
+				//keep the previous status for the audit journal
+				var previous string
+				if disabled, ok := getWAFDisabled(config.APIEndpoint, *apiKey, *serviceID, waf.ID, activeVersion); ok {
+					previous = "enable"
+					if disabled {
+						previous = "disable"
+					}
+				}
 				//rule management
-				changeStatus(config.APIEndpoint, *apiKey, waf.ID, *status)
-				Info.Println("Completed")
-				os.Exit(0)
+				changeStatus(config.APIEndpoint, *apiKey, waf.ID, previous, *status)
+
+			case *planPromotion:
+				Info.Println("Adding rules to the promotion plan")
+				Warning.Println("Publisher, Rules, OWASP Settings and Tags changes are versionless actions and thus do not generate a new config version")
+
+				pp := wafFilePath(*promotionPath, *serviceID, waf.ID, len(selected) > 1)
+
+				if !addToPromotionPlan(config.APIEndpoint, *apiKey, *serviceID, waf.ID, client, config, pp, *soakDays) {
+					os.Exit(1)
+				}
+
+			case *promote:
+				Info.Println("Promoting soaked rules to block")
+				Warning.Println("Publisher, Rules, OWASP Settings and Tags changes are versionless actions and thus do not generate a new config version")
+
+				pp := wafFilePath(*promotionPath, *serviceID, waf.ID, len(selected) > 1)
+
+				if !promoteRules(config.APIEndpoint, *apiKey, *serviceID, waf.ID, client, config, pp, strings.Split(*wafLogs, ","), *promoteThreshold) {
+					os.Exit(1)
+				}
 
 			case *tags != "":
 
 				Info.Println("Editing Tags")
 				Warning.Println("Publisher, Rules, OWASP Settings and Tags changes are versionless actions and thus do not generate a new config version")
 
+				//snapshot rule statuses for a guarded change
+				guard, ok := captureRuleGuard(client, config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *guardWindow, *watchInterval, *guardSamples, *watchSource, *rtEndpoint)
+				if !ok {
+					os.Exit(1)
+				}
+
 				//tags management
 				tagsConfig(config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *forceStatus)
 
@@ -2108,6 +2953,9 @@ func main() {
 				if PatchRules(*serviceID, waf.ID, client, *apiKey) {
 					Info.Println("Rule set successfully patched")
 
+					if !guardRuleChange(guard, client, config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *guardWindow, *watchInterval, *guardMultiple, *guardMinRate) {
+						os.Exit(1)
+					}
 				} else {
 					Error.Println("Issue patching ruleset see above error..")
 				}
@@ -2116,6 +2964,12 @@ func main() {
 				Info.Println("Editing Publishers")
 				Warning.Println("Publisher, Rules, OWASP Settings and Tags changes are versionless actions and thus do not generate a new config version")
 
+				//snapshot rule statuses for a guarded change
+				guard, ok := captureRuleGuard(client, config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *guardWindow, *watchInterval, *guardSamples, *watchSource, *rtEndpoint)
+				if !ok {
+					os.Exit(1)
+				}
+
 				//Publisher management
 				publisherConfig(config.APIEndpoint, *apiKey, *serviceID, waf.ID, config)
 
@@ -2123,6 +2977,9 @@ func main() {
 				if PatchRules(*serviceID, waf.ID, client, *apiKey) {
 					Info.Println("Rule set successfully patched")
 
+					if !guardRuleChange(guard, client, config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *guardWindow, *watchInterval, *guardMultiple, *guardMinRate) {
+						os.Exit(1)
+					}
 				} else {
 					Error.Println("Issue patching ruleset see above error..")
 				}
@@ -2131,6 +2988,12 @@ func main() {
 				Info.Println("Editing Rules")
 				Warning.Println("Publisher, Rules, OWASP Settings and Tags changes are versionless actions and thus do not generate a new config version")
 
+				//snapshot rule statuses for a guarded change
+				guard, ok := captureRuleGuard(client, config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *guardWindow, *watchInterval, *guardSamples, *watchSource, *rtEndpoint)
+				if !ok {
+					os.Exit(1)
+				}
+
 				//rule management
 				rulesConfig(config.APIEndpoint, *apiKey, *serviceID, waf.ID, config)
 
@@ -2138,6 +3001,9 @@ func main() {
 				if PatchRules(*serviceID, waf.ID, client, *apiKey) {
 					Info.Println("Rule set successfully patched")
 
+					if !guardRuleChange(guard, client, config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *guardWindow, *watchInterval, *guardMultiple, *guardMinRate) {
+						os.Exit(1)
+					}
 				} else {
 					Error.Println("Issue patching ruleset see above error..")
 				}
@@ -2146,7 +3012,23 @@ func main() {
 				Info.Printf("Editing OWASP settings for WAF #%v\n", index+1)
 				Warning.Println("Publisher, Rules, OWASP Settings and Tags changes are versionless actions and thus do not generate a new config version")
 
-				createOWASP(client, *serviceID, config, waf.ID)
+				createOWASP(client, *serviceID, config, waf.ID, owaspKeys)
+
+				//patch ruleset
+				if PatchRules(*serviceID, waf.ID, client, *apiKey) {
+					Info.Println("Rule set successfully patched")
+
+				} else {
+					Error.Println("Issue patching ruleset see above error..")
+				}
+
+			case len(listEdits) > 0:
+				Info.Printf("Editing OWASP list settings for WAF #%v\n", index+1)
+				Warning.Println("Publisher, Rules, OWASP Settings and Tags changes are versionless actions and thus do not generate a new config version")
+
+				if !editOWASPLists(client, *serviceID, waf.ID, config, listEdits) {
+					os.Exit(1)
+				}
 
 				//patch ruleset
 				if PatchRules(*serviceID, waf.ID, client, *apiKey) {
@@ -2158,23 +3040,74 @@ func main() {
 
 			case *withPX:
 				Info.Println("WAF enabled with PerimeterX, setting logging conditions")
-				version := cloneVersion(client, *serviceID, activeVersion, *addComment)
+				version := draftVersion(client, *serviceID, activeVersion, *serviceVersion, *addComment)
 				AddLoggingCondition(client, *serviceID, version, config, *withPX)
-				validateVersion(client, *serviceID, activeVersion)
+				finishVersion(client, *serviceID, activeVersion, version, config)
+				Info.Println("Completed")
+				os.Exit(0)
 
 			//back up WAF rules locally
 			case *backup:
 				Info.Println("Backing up WAF configuration")
 
-				bp := strings.Replace(*backupPath, "<service-id>", *serviceID, -1)
+				bp := wafFilePath(*backupPath, *serviceID, waf.ID, len(selected) > 1)
 
 				if !backupConfig(*apiEndpoint, *apiKey, *serviceID, waf.ID, client, bp) {
 					os.Exit(1)
 				}
 
+			//document the WAF posture
+			case *report:
+				Info.Printf("Writing posture report of WAF %s on version %v\n", waf.ID, baseVersion)
+
+				rp := wafFilePath(*reportPath, *serviceID, waf.ID, len(selected) > 1)
+
+				if !writeReport(client, config.APIEndpoint, *apiKey, *serviceID, waf, baseVersion, rp, *reportFormat) {
+					os.Exit(1)
+				}
+
+			//evaluate the WAF against a policy
+			case *policyPath != "":
+				Info.Printf("Checking WAF %s on version %v against policy %s\n", waf.ID, baseVersion, *policyPath)
+
+				rp := *checkReportPath
+				if rp != "" {
+					rp = wafFilePath(rp, *serviceID, waf.ID, len(selected) > 1)
+				}
+
+				if !checkPolicy(client, config.APIEndpoint, *apiKey, *serviceID, waf, baseVersion, *policyPath, rp, *checkFormat) {
+					failed = true
+				}
+
+			//bring a service set up by hand under config control
+			case *exportCfg:
+				Info.Printf("Exporting WAF configuration from version %v\n", baseVersion)
+
+				ep := wafFilePath(*exportPath, *serviceID, waf.ID, len(selected) > 1)
+
+				if !exportConfig(client, config.APIEndpoint, *apiKey, *serviceID, waf, baseVersion, ep) {
+					os.Exit(1)
+				}
+
+			//hand the WAF setup over to Terraform
+			case *exportTF:
+				Info.Printf("Exporting WAF configuration as Terraform from version %v\n", baseVersion)
+
+				tp := wafFilePath(*terraformPath, *serviceID, waf.ID, len(selected) > 1)
+
+				if !exportTerraform(client, config.APIEndpoint, *apiKey, *serviceID, waf, baseVersion, tp) {
+					os.Exit(1)
+				}
+
 			case *provision:
 				Warning.Println("Publisher, Rules, OWASP Settings and Tags changes are versionless actions and thus do not generate a new config version")
 
+				//snapshot rule statuses for a guarded change
+				guard, ok := captureRuleGuard(client, config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *guardWindow, *watchInterval, *guardSamples, *watchSource, *rtEndpoint)
+				if !ok {
+					os.Exit(1)
+				}
+
 				//tags management
 				tagsConfig(config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *forceStatus)
 				//rule management
@@ -2182,12 +3115,15 @@ func main() {
 				//publisher management
 				publisherConfig(config.APIEndpoint, *apiKey, *serviceID, waf.ID, config)
 				//OWASP
-				createOWASP(client, *serviceID, config, waf.ID)
+				createOWASP(client, *serviceID, config, waf.ID, owaspKeys)
 
 				//patch ruleset
 				if PatchRules(*serviceID, waf.ID, client, *apiKey) {
 					Info.Println("Rule set successfully patched")
 
+					if !guardRuleChange(guard, client, config.APIEndpoint, *apiKey, *serviceID, waf.ID, config, *guardWindow, *watchInterval, *guardMultiple, *guardMinRate) {
+						os.Exit(1)
+					}
 				} else {
 					Error.Println("Issue patching ruleset see above error..")
 				}
@@ -2196,20 +3132,28 @@ func main() {
 				Error.Println("Nothing to do. Exiting")
 				os.Exit(1)
 			}
+		}
 
-			//validate the config
-			Info.Println("Completed")
-			os.Exit(0)
+		if failed {
+			Error.Println("Policy check failed..see above for details")
+			os.Exit(1)
 		}
 
+		Info.Println("Completed")
+		os.Exit(0)
+
+	} else if *policyPath != "" {
+		Error.Printf("Policy check failed: no WAF found on Service ID %s version %v\n", *serviceID, baseVersion)
+		os.Exit(1)
+
 	} else if *provision {
 		Warning.Printf("Provisioning a new WAF on Service ID: %s\n", *serviceID)
 
 		//clone current version
-		version := cloneVersion(client, *serviceID, activeVersion, *addComment)
+		version := draftVersion(client, *serviceID, activeVersion, *serviceVersion, *addComment)
 
 		//provision a new WAF service
-		wafID := provisionWAF(client, *serviceID, config, version)
+		wafID := provisionWAF(client, *serviceID, config, version, owaspKeys, *omitLogs, *withPX)
 
 		//publisher management
 		publisherConfig(config.APIEndpoint, *apiKey, *serviceID, wafID, config)
@@ -2223,18 +3167,8 @@ func main() {
 		//Default Disabled
 		DefaultRuleDisabled(config.APIEndpoint, *apiKey, *serviceID, wafID, config)
 
-		//Add logging conditions
-		// Ensure logging is defined in config and not being explicitly omitted
-		if !*omitLogs && config.Weblog.Name != "" {
-			AddLoggingCondition(client, *serviceID, version, config, *withPX)
-		}
-
-		latest, err := client.LatestVersion(&fastly.LatestVersionInput{
-			Service: *serviceID,
-		})
-		if err != nil {
-			Error.Fatal(err)
-		}
+		//rules in the other action
+		provisioningRules(config.APIEndpoint, *apiKey, *serviceID, wafID, config)
 
 		//patch ruleset
 		if PatchRules(*serviceID, wafID, client, *apiKey) {
@@ -2245,7 +3179,7 @@ func main() {
 		}
 
 		//validate the config
-		validateVersion(client, *serviceID, latest.Number)
+		finishVersion(client, *serviceID, activeVersion, version, config)
 		Info.Println("Completed")
 		os.Exit(0)
 	} else {
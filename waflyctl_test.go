@@ -0,0 +1,22 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain silences the loggers the functions under test write to
+func TestMain(m *testing.M) {
+	Info = log.New(ioutil.Discard, "", 0)
+	Warning = log.New(ioutil.Discard, "", 0)
+	Error = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,227 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fastly/go-fastly/fastly"
+)
+
+// wafTraffic holds the WAF counters of a service over a period of time
+type wafTraffic struct {
+	Seconds              float64
+	Requests             uint64
+	Logged               uint64
+	Blocked              uint64
+	Passed               uint64
+	AttackReqBodyBytes   uint64
+	AttackReqHeaderBytes uint64
+	AttackRespSynthBytes uint64
+}
+
+// wafTrafficSampler returns the WAF traffic seen since its previous call
+type wafTrafficSampler func() (wafTraffic, error)
+
+// add accumulates a stats data point into the traffic sample
+func (t *wafTraffic) add(s *fastly.Stats, seconds float64) {
+	if s == nil {
+		return
+	}
+	t.Seconds += seconds
+	t.Requests += s.Requests
+	t.Logged += s.WAFLogged
+	t.Blocked += s.WAFBlocked
+	t.Passed += s.WAFPassed
+	t.AttackReqBodyBytes += s.AttackRequestBodyBytes
+	t.AttackReqHeaderBytes += s.AttachRequestHeaderBytes
+	t.AttackRespSynthBytes += s.AttackResponseSynthBytes
+}
+
+// merge adds the counters of another sample to the traffic sample
+func (t *wafTraffic) merge(o wafTraffic) {
+	t.Seconds += o.Seconds
+	t.Requests += o.Requests
+	t.Logged += o.Logged
+	t.Blocked += o.Blocked
+	t.Passed += o.Passed
+	t.AttackReqBodyBytes += o.AttackReqBodyBytes
+	t.AttackReqHeaderBytes += o.AttackReqHeaderBytes
+	t.AttackRespSynthBytes += o.AttackRespSynthBytes
+}
+
+// rate converts a counter of the sample into a per second value
+func (t wafTraffic) rate(counter uint64) float64 {
+	if t.Seconds == 0 {
+		return 0
+	}
+	return float64(counter) / t.Seconds
+}
+
+// realtimeSampler polls the realtime stats API, each call returns the seconds recorded since the previous one
+func realtimeSampler(rts *fastly.RTSClient, serviceID string) wafTrafficSampler {
+	var timestamp uint64
+	return func() (wafTraffic, error) {
+		t := wafTraffic{}
+		resp, err := rts.GetRealtimeStats(&fastly.GetRealtimeStatsInput{
+			Service:   serviceID,
+			Timestamp: timestamp,
+		})
+		if err != nil {
+			return t, err
+		}
+		if resp.Error != "" {
+			return t, fmt.Errorf("%s", resp.Error)
+		}
+		timestamp = resp.Timestamp
+		for _, d := range resp.Data {
+			t.add(d.Aggregated, 1)
+		}
+		return t, nil
+	}
+}
+
+// minuteStats is a bucket of the historical stats API with the minute it starts at
+type minuteStats struct {
+	StartTime            int64  `json:"start_time"`
+	Requests             uint64 `json:"requests"`
+	WAFLogged            uint64 `json:"waf_logged"`
+	WAFBlocked           uint64 `json:"waf_blocked"`
+	WAFPassed            uint64 `json:"waf_passed"`
+	AttackReqBodyBytes   uint64 `json:"attack_req_body_bytes"`
+	AttackReqHeaderBytes uint64 `json:"attack_req_header_bytes"`
+	AttackRespSynthBytes uint64 `json:"attack_resp_synth_bytes"`
+}
+
+// minutelySampler polls the historical stats API, each call returns the complete minutes recorded
+// since the previous one. The first call returns the latest complete minute.
+func minutelySampler(client *fastly.Client, serviceID string) wafTrafficSampler {
+	var last int64
+	return func() (wafTraffic, error) {
+		t := wafTraffic{}
+		var resp struct {
+			Status string        `json:"status"`
+			Msg    string        `json:"msg"`
+			Data   []minuteStats `json:"data"`
+		}
+		now := time.Now().Unix()
+		err := client.GetStatsJSON(&fastly.GetStatsInput{
+			Service: serviceID,
+			From:    strconv.FormatInt(now-10*60, 10),
+			To:      strconv.FormatInt(now, 10),
+			By:      "minute",
+		}, &resp)
+		if err != nil {
+			return t, err
+		}
+		if resp.Status != "" && resp.Status != "success" {
+			return t, fmt.Errorf("%s", resp.Msg)
+		}
+
+		//the minute still in progress is left for a later call
+		var complete []minuteStats
+		for _, m := range resp.Data {
+			if m.StartTime+60 <= now && m.StartTime > last {
+				complete = append(complete, m)
+			}
+		}
+		if last == 0 && len(complete) > 1 {
+			complete = complete[len(complete)-1:]
+		}
+		for _, m := range complete {
+			t.add(&fastly.Stats{
+				Requests:                 m.Requests,
+				WAFLogged:                m.WAFLogged,
+				WAFBlocked:               m.WAFBlocked,
+				WAFPassed:                m.WAFPassed,
+				AttackRequestBodyBytes:   m.AttackReqBodyBytes,
+				AttachRequestHeaderBytes: m.AttackReqHeaderBytes,
+				AttackResponseSynthBytes: m.AttackRespSynthBytes,
+			}, 60)
+			last = m.StartTime
+		}
+		return t, nil
+	}
+}
+
+// newWAFTrafficSampler picks the stats source used to follow WAF traffic
+func newWAFTrafficSampler(client *fastly.Client, apiKey, serviceID, source, rtEndpoint string) (wafTrafficSampler, bool) {
+	switch source {
+	case "minutely":
+		return minutelySampler(client, serviceID), true
+	default:
+		rts, err := fastly.NewRealtimeStatsClientForEndpoint(apiKey, rtEndpoint)
+		if err != nil {
+			Error.Println(err)
+			return nil, false
+		}
+		return realtimeSampler(rts, serviceID), true
+	}
+}
+
+// humanBytes formats a byte counter for the terminal
+func humanBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// watchWAF displays WAF traffic for a service until interrupted, or for count samples when count is positive
+func watchWAF(sample wafTrafficSampler, serviceID, source string, interval time.Duration, alertBlocked, alertLogged float64, count int) bool {
+
+	total := wafTraffic{}
+	current := wafTraffic{}
+	for i := 0; count <= 0 || i < count; i++ {
+		t, err := sample()
+		if err != nil {
+			Error.Printf("Cannot read stats for service %q: %v\n", serviceID, err)
+			return false
+		}
+		//a poll without new stats keeps showing the latest rates
+		fresh := t.Seconds > 0
+		if fresh {
+			current = t
+		}
+		total.merge(t)
+
+		//redraw the view in place
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("WAF traffic for service %s (%s stats, updated %s)\n\n", serviceID, source, time.Now().Format("15:04:05"))
+		fmt.Printf("%-24s %14s %14s\n", "", "per second", "total")
+		fmt.Printf("%-24s %14.2f %14d\n", "Requests", current.rate(current.Requests), total.Requests)
+		fmt.Printf("%-24s %14.2f %14d\n", "WAF logged", current.rate(current.Logged), total.Logged)
+		fmt.Printf("%-24s %14.2f %14d\n", "WAF blocked", current.rate(current.Blocked), total.Blocked)
+		fmt.Printf("%-24s %14.2f %14d\n", "WAF passed", current.rate(current.Passed), total.Passed)
+		fmt.Println()
+		fmt.Printf("%-24s %14s\n", "Attack request headers", humanBytes(total.AttackReqHeaderBytes))
+		fmt.Printf("%-24s %14s\n", "Attack request bodies", humanBytes(total.AttackReqBodyBytes))
+		fmt.Printf("%-24s %14s\n", "Attack synthetic resp.", humanBytes(total.AttackRespSynthBytes))
+		fmt.Println()
+
+		if fresh && alertBlocked > 0 && t.rate(t.Blocked) > alertBlocked {
+			Warning.Printf("\aWAF blocked rate %.2f/s is above the alert threshold of %.2f/s\n", t.rate(t.Blocked), alertBlocked)
+		}
+		if fresh && alertLogged > 0 && t.rate(t.Logged) > alertLogged {
+			Warning.Printf("\aWAF logged rate %.2f/s is above the alert threshold of %.2f/s\n", t.rate(t.Logged), alertLogged)
+		}
+
+		if count <= 0 || i < count-1 {
+			time.Sleep(interval)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,306 @@
+/*
+ * WAF provisioning tool
+ *
+ * Copyright (c) 2018-2019 Fastly Inc.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// stackTags are the rule tags suggested for an application stack
+var stackTags = map[string][]string{
+	"wordpress": {"wordpress", "language-php"},
+	"drupal":    {"drupal", "language-php"},
+	"joomla":    {"joomla", "language-php"},
+	"php":       {"language-php"},
+	"java":      {"language-java"},
+	"windows":   {"platform-windows"},
+	"other":     {},
+}
+
+// wizardAnswers is what the init wizard asked for
+type wizardAnswers struct {
+	Tags           []string
+	Action         string
+	ParanoiaLevel  int
+	Logging        bool
+	Address        string
+	Port           int
+	TLSHostname    string
+	TLSCACert      string
+	HTTPStatusCode int
+	HTTPResponse   string
+	ContentType    string
+	Content        string
+}
+
+// wizardConfig lays out the starter config written by the init wizard
+const wizardConfig = `# waflyctl config written by waflyctl --init
+# check it with: waflyctl --config <this file> --validate-config
+
+schema_version = {{schemaVersion}}
+logpath = "waflyctl.log"
+
+# rule tags for the application stack, see --list-all-rules for what a tag holds
+tags = {{toml .Tags}}
+publisher = ["owasp"]
+
+# rollout mode: log only records matches, block rejects them. Start with log, watch the
+# WAF logs and move rules to block once they stop matching legitimate traffic.
+action = {{toml .Action}}
+rules = []
+
+[provisioning]
+# ONLY during new WAF provisionings we disabled the following list of rules by default
+disabledrules = []
+
+[owasp]
+# OWASP generic settings, a higher paranoia level catches more attacks and more false positives
+ParanoiaLevel = {{.ParanoiaLevel}}
+AllowedHTTPVersions = "HTTP/1.0 HTTP/1.1 HTTP/2"
+AllowedMethods = "GET HEAD POST OPTIONS PUT PATCH DELETE"
+AllowedRequestContentType = "application/x-www-form-urlencoded|multipart/form-data|text/xml|application/xml|application/soap+xml|application/x-amf|application/json|application/octet-stream|application/csp-report|application/xss-auditor-report|text/plain"
+AllowedRequestContentTypeCharset = "utf-8|iso-8859-1|iso-8859-15|windows-1252"
+ArgLength = 800
+ArgNameLength = 800
+CombinedFileSizes = 10000000
+CRSValidateUTF8Encoding = false
+MaxFileSize = 10000000
+MaxNumArgs = 255
+TotalArgLength = 6400
+RestrictedExtensions = ".asa/ .asax/ .ascx/ .axd/ .backup/ .bak/ .bat/ .cdx/ .cer/ .cfg/ .cmd/ .com/ .config/ .conf/ .cs/ .csproj/ .csr/ .dat/ .db/ .dbf/ .dll/ .dos/ .htr/ .htw/ .ida/ .idc/ .idq/ .inc/ .ini/ .key/ .licx/ .lnk/ .log/ .mdb/ .old/ .pass/ .pdb/ .pol/ .printer/ .pwd/ .resources/ .resx/ .sql/ .sys/ .vb/ .vbs/ .vbproj/ .vsdisco/ .webinfo/ .xsd/ .xsx/"
+RestrictedHeaders = "/proxy/ /lock-token/ /content-range/ /translate/ /if/"
+
+# OWASP score settings
+InboundAnomalyScoreThreshold = 10
+CriticalAnomalyScore = 5
+ErrorAnomalyScore = 4
+WarningAnomalyScore = 3
+NoticeAnomalyScore = 2
+HTTPViolationScoreThreshold = 5
+LFIScoreThreshold = 5
+PHPInjectionScoreThreshold = 5
+RCEScoreThreshold = 5
+RFIScoreThreshold = 5
+SessionFixationScoreThreshold = 5
+SQLInjectionScoreThreshold = 5
+XSSScoreThreshold = 5
+{{if .Logging}}
+# request logs of requests the WAF looked at
+[weblog]
+name = "weblogs"
+address = {{toml .Address}}
+port = {{.Port}}
+tlshostname = {{toml .TLSHostname}}
+{{- if .TLSCACert}}
+tlscacert = '''
+{{.TLSCACert}}'''
+{{- end}}
+format = '''{\"type\":\"req\",\"service_id\":\"%{req.service_id}V\",\"request_id\":\"%{req.http.fastly-soc-x-request-id}V\",\"start_time\":\"%{time.start.sec}V\",\"fastly_info\":\"%{fastly_info.state}V\",\"datacenter\":\"%{server.datacenter}V\",\"client_ip\":\"%a\",\"req_method\":\"%m\",\"req_uri\":\"%{cstr_escape(req.url)}V\",\"req_h_host\":\"%{cstr_escape(req.http.Host)}V\",\"req_h_user_agent\":\"%{cstr_escape(req.http.User-Agent)}V\",\"req_h_accept_encoding\":\"%{cstr_escape(req.http.Accept-Encoding)}V\",\"req_header_bytes\":\"%{req.header_bytes_read}V\",\"req_body_bytes\":\"%{req.body_bytes_read}V\",\"waf_logged\":\"%{waf.logged}V\",\"waf_blocked\":\"%{waf.blocked}V\",\"waf_failures\":\"%{waf.failures}V\",\"waf_executed\":\"%{waf.executed}V\",\"anomaly_score\":\"%{waf.anomaly_score}V\",\"sql_injection_score\":\"%{waf.sql_injection_score}V\",\"rfi_score\":\"%{waf.rfi_score}V\",\"lfi_score\":\"%{waf.lfi_score}V\",\"rce_score\":\"%{waf.rce_score}V\",\"php_injection_score\":\"%{waf.php_injection_score}V\",\"session_fixation_score\":\"%{waf.session_fixation_score}V\",\"http_violation_score\":\"%{waf.http_violation_score}V\",\"xss_score\":\"%{waf.xss_score}V\",\"resp_status\":\"%{resp.status}V\",\"resp_bytes\":\"%{resp.bytes_written}V\",\"resp_header_bytes\":\"%{resp.header_bytes_written}V\",\"resp_body_bytes\":\"%{resp.body_bytes_written}V\"}'''
+
+# one log line per rule match
+[waflog]
+name = "waflogs"
+address = {{toml .Address}}
+port = {{.Port}}
+tlshostname = {{toml .TLSHostname}}
+{{- if .TLSCACert}}
+tlscacert = '''
+{{.TLSCACert}}'''
+{{- end}}
+format = '''{\"type\":\"waf\",\"request_id\":\"%{req.http.fastly-soc-x-request-id}V\",\"rule_id\":\"%{waf.rule_id}V\",\"severity\":\"%{waf.severity}V\",\"anomaly_score\":\"%{waf.anomaly_score}V\",\"logdata\":\"%{json.escape(waf.logdata)}V\",\"waf_message\":\"%{json.escape(waf.message)}V\"}'''
+{{else}}
+# no logging endpoints, add [weblog] and [waflog] sections to send WAF logs to syslog
+{{end}}
+# tags every request with an ID shared by its request and WAF log lines
+[vclsnippet]
+name = "Fastly_WAF_Snippet"
+content = '''
+if (!req.http.fastly-soc-x-request-id)
+{
+  set req.http.fastly-soc-x-request-id = digest.hash_sha256(now randomstr(64) req.http.host req.url req.http.Fastly-Client-IP server.identity);
+}
+'''
+type = "recv"
+priority = 10
+dynamic = 1
+
+# page returned for blocked requests
+[response]
+name = "WAF_Response"
+httpstatuscode = {{.HTTPStatusCode}}
+httpresponse = {{toml .HTTPResponse}}
+contenttype = {{toml .ContentType}}
+content = {{toml .Content}}
+
+# only requests going to origin are inspected
+[prefetch]
+name = "WAF_Prefetch"
+statement = "req.backend.is_origin"
+type = "PREFETCH"
+priority = 10
+`
+
+// wizardPrompt reads answers from the terminal
+type wizardPrompt struct {
+	in *bufio.Reader
+}
+
+// ask shows a question with its default and returns the answer or the default
+func (p wizardPrompt) ask(question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, _ := p.in.ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def
+	}
+	return answer
+}
+
+// choose asks until the answer is one of the choices
+func (p wizardPrompt) choose(question string, choices []string, def string) string {
+	for {
+		answer := strings.ToLower(p.ask(fmt.Sprintf("%s (%s)", question, strings.Join(choices, ", ")), def))
+		for _, c := range choices {
+			if answer == c {
+				return c
+			}
+		}
+		fmt.Printf("Please answer one of: %s\n", strings.Join(choices, ", "))
+	}
+}
+
+// number asks until the answer is a number between min and max
+func (p wizardPrompt) number(question string, def, min, max int) int {
+	for {
+		n, err := strconv.Atoi(p.ask(question, strconv.Itoa(def)))
+		if err == nil && n >= min && n <= max {
+			return n
+		}
+		fmt.Printf("Please answer a number between %d and %d\n", min, max)
+	}
+}
+
+// askAnswers walks through the wizard questions
+func askAnswers(p wizardPrompt) (wizardAnswers, bool) {
+	a := wizardAnswers{}
+
+	stack := p.choose("Application stack", sortedKeys(stackTags), "other")
+	suggested := strings.Join(stackTags[stack], ",")
+	for _, t := range strings.Split(p.ask("Rule tags, comma delimited", suggested), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			a.Tags = append(a.Tags, t)
+		}
+	}
+
+	a.Action = p.choose("Rollout mode, log to watch first or block right away", []string{"log", "block"}, "log")
+	a.ParanoiaLevel = p.number("Paranoia level, 1 is the least strict and 4 the most", 1, 1, 4)
+
+	//the logging endpoints are always provisioned with TLS
+	if p.choose("Logging destination protocol", []string{"tls", "none"}, "tls") == "tls" {
+		a.Logging = true
+		a.Address = p.ask("Syslog address", "")
+		if a.Address == "" {
+			fmt.Println("A syslog address is needed for logging, answer none to go without")
+			return a, false
+		}
+		a.Port = p.number("Syslog port", 514, 1, 65535)
+		a.TLSHostname = p.ask("TLS hostname of the syslog server", a.Address)
+		if cpath := p.ask("File with the CA certificate of the syslog server, empty for a public CA", ""); cpath != "" {
+			b, err := ioutil.ReadFile(cpath)
+			if err != nil {
+				fmt.Println("Cannot read CA certificate -", err)
+				return a, false
+			}
+			a.TLSCACert = strings.TrimSpace(string(b)) + "\n"
+		}
+	}
+
+	a.HTTPStatusCode = p.number("HTTP status code of the block page", 403, 100, 599)
+	a.HTTPResponse = p.ask("HTTP response text of the block page", "Forbidden")
+	a.ContentType = p.ask("Content type of the block page", "text/plain")
+	a.Content = p.ask("Content of the block page", strconv.Itoa(a.HTTPStatusCode)+" "+a.HTTPResponse)
+	return a, true
+}
+
+// initWizard asks about the service and writes a starter config that validates cleanly, commented
+// when it is TOML
+func initWizard(cpath string) bool {
+	p := wizardPrompt{in: bufio.NewReader(os.Stdin)}
+
+	if _, err := os.Stat(cpath); err == nil {
+		if answer := p.ask(fmt.Sprintf("%s exists, overwrite it? [y/N]", cpath), ""); strings.ToLower(answer) != "y" {
+			fmt.Println("Leaving", cpath, "alone")
+			return false
+		}
+	}
+
+	answers, ok := askAnswers(p)
+	if !ok {
+		return false
+	}
+
+	buf := new(bytes.Buffer)
+	t := template.Must(template.New("config").Funcs(template.FuncMap{"toml": renderValue, "schemaVersion": func() int { return configSchemaVersion }}).Parse(wizardConfig))
+	if err := t.Execute(buf, answers); err != nil {
+		fmt.Println("Could not write config -", err)
+		return false
+	}
+
+	//the written config goes through the same checks as --validate-config
+	tmp, err := ioutil.TempFile("", "waflyctl-init")
+	if err != nil {
+		fmt.Println("Could not write config -", err)
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Write(buf.Bytes())
+	tmp.Close()
+	config, layered, err := loadConfig(tmp.Name(), nil, "", nil)
+	if err != nil {
+		fmt.Println("Could not read the written config -", err)
+		return false
+	}
+	for _, problem := range validateConfig(config, layered) {
+		fmt.Printf("Config problem %s: %s\n", problem.Key, problem.Message)
+		if !problem.Warning {
+			ok = false
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	//a .yaml, .yml or .json path gets the same config in its format, without the comments
+	doc := buf.Bytes()
+	if configFormat(cpath) != "toml" {
+		tree, err := decodeTree(tmp.Name(), doc)
+		if err == nil {
+			doc, err = encodeDocument(cpath, tree)
+		}
+		if err != nil {
+			fmt.Println("Could not write config -", err)
+			return false
+		}
+	}
+
+	if err := ioutil.WriteFile(cpath, doc, 0600); err != nil {
+		fmt.Println("Could not write config -", err)
+		return false
+	}
+	fmt.Printf("Config written to %s, provision with: waflyctl --config %s --serviceid <service-id> --provision\n", cpath, cpath)
+	return true
+}